@@ -0,0 +1,131 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
+)
+
+// checkpoint keeps the pages fetched so far, so that an interrupted fetch
+// can be resumed. The file is in JSON Lines format: the header with the
+// query first, then a line for each page, in order.
+type checkpoint struct {
+	fn    string
+	pages int
+}
+
+type checkpointHeader struct {
+	Query string `json:"query"`
+}
+
+type checkpointPage struct {
+	Page     int               `json:"page"`
+	Mentions []mention.Mention `json:"mentions"`
+}
+
+// checkpointFile returns the file to keep the checkpoint of fetching to
+// the archive in, or "" if no checkpoint is to be kept.
+func checkpointFile(c cfg) string {
+	if c.plan != nil {
+		// dry runs don't write anything
+		return ""
+	}
+	return archivePath(c) + ".checkpoint"
+}
+
+// openCheckpoint returns the checkpoint for the query, along with the
+// mentions from the pages already fetched. A checkpoint for a different
+// query is discarded.
+func openCheckpoint(fn, query string) (*checkpoint, []mention.Mention, error) {
+	cp := &checkpoint{fn: fn}
+	mm, err := cp.read(query)
+	if err == nil {
+		return cp, mm, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	cp.pages = 0
+	b, err := json.Marshal(checkpointHeader{query})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cp, nil, safefile.Write(fn, append(b, '\n'), 0)
+}
+
+// read reads the pages from the file, returning an os.ErrNotExist error
+// if there is no usable checkpoint for the query.
+func (cp *checkpoint) read(query string) (mm []mention.Mention, err error) {
+	b, err := ioutil.ReadFile(cp.fn)
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var h checkpointHeader
+	if dec.Decode(&h) != nil || h.Query != query {
+		return nil, os.ErrNotExist
+	}
+	good := dec.InputOffset()
+	for dec.More() {
+		var p checkpointPage
+		if dec.Decode(&p) != nil || p.Page != cp.pages {
+			// a broken last line, keep what's fine
+			return mm, safefile.Write(cp.fn, append(b[:good:good], '\n'), 0)
+		}
+		mm = append(mm, p.Mentions...)
+		cp.pages++
+		good = dec.InputOffset()
+	}
+	return
+}
+
+// add records the page as fetched.
+func (cp *checkpoint) add(page int, mm []mention.Mention) error {
+	if page != cp.pages {
+		return fmt.Errorf("checkpoint: want page %d, got %d", cp.pages, page)
+	}
+	var bb bytes.Buffer
+	enc := json.NewEncoder(&bb)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(checkpointPage{page, mm}); err != nil {
+		return err
+	}
+	if err := safefile.Append(cp.fn, bb.Bytes(), 0); err != nil {
+		return err
+	}
+	cp.pages++
+	return nil
+}
+
+// removeCheckpoint removes the checkpoint once the fetched mentions are
+// saved.
+func removeCheckpoint(fn string) error {
+	if fn == "" {
+		return nil
+	}
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResumeFetch(t *testing.T) {
+	retries.attempts = 0
+	defer func() { retries.attempts = 5 }()
+
+	const pages = 5
+	failing := 3
+	var requested []int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		requested = append(requested, page)
+		if page == failing {
+			http.NotFound(w, r)
+			return
+		}
+		var mm []string
+		for i := 0; page < pages && i < 2; i++ {
+			id := page*2 + i + 1
+			mm = append(mm, fmt.Sprintf(`{"id":%d,"source":"https://src.example/%d","verified_date":"2021-06-07T22:21:%02dZ"}`, id, id, id))
+		}
+		fmt.Fprintf(w, `{"links":[%s]}`, strings.Join(mm, ","))
+	}))
+	defer ts.Close()
+
+	c := cfg{api: ts.URL, token: "s3cr3t", filename: filepath.Join(t.TempDir(), "wm.json")}
+	cp := checkpointFile(c)
+
+	if err := fetchInto(context.Background(), c); err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if _, err := os.Stat(c.filename); !os.IsNotExist(err) {
+		t.Fatalf("want nothing saved, got %v", err)
+	}
+	b, err := ioutil.ReadFile(cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cr3t") {
+		t.Fatalf("token saved to checkpoint: %s", b)
+	}
+
+	failing = -1
+	requested = nil
+	if err := fetchInto(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 4, 5}; !reflect.DeepEqual(requested, want) {
+		t.Fatalf("want pages %v requested, got %v", want, requested)
+	}
+	mm, err := readFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != pages*2 {
+		t.Fatalf("want %d mentions, got %d", pages*2, len(mm))
+	}
+	if _, err := os.Stat(cp); !os.IsNotExist(err) {
+		t.Fatalf("want checkpoint removed, got %v", err)
+	}
+}
+
+func TestOpenCheckpoint(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "wm.json.checkpoint")
+	cp, mm, err := openCheckpoint(fn, "query")
+	if err != nil || len(mm) != 0 {
+		t.Fatalf("want empty checkpoint, got %v, %v", mm, err)
+	}
+	for page := 0; page < 2; page++ {
+		if err := cp.add(page, mustParse(t, fmt.Sprintf(`[{"id":%d}]`, page+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cp.add(5, nil); err == nil {
+		t.Fatal("want error for a page out of order")
+	}
+
+	// a broken line at the end, i.e. after a crash
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(f, `{"page":2,"menti`)
+	f.Close()
+
+	cp, mm, err = openCheckpoint(fn, "query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 2 || cp.pages != 2 {
+		t.Fatalf("want 2 pages with 2 mentions, got %d with %d", cp.pages, len(mm))
+	}
+	if err := cp.add(2, mustParse(t, `[{"id":3}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if cp, _, _ = openCheckpoint(fn, "query"); cp.pages != 3 {
+		t.Fatalf("want 3 pages after repair, got %d", cp.pages)
+	}
+
+	// the archive has changed since, so has the query
+	if cp, mm, err = openCheckpoint(fn, "other query"); err != nil || cp.pages != 0 || len(mm) != 0 {
+		t.Fatalf("want checkpoint discarded, got %d pages, %v", cp.pages, err)
+	}
+}
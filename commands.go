@@ -0,0 +1,467 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultCommand = "fetch"
+
+// command is a subcommand of the program.
+type command struct {
+	name    string
+	args    string
+	summary string
+	// flags defines the command's flags that set config values
+	flags func(fs *flag.FlagSet, c *cfg)
+	run   func(ctx context.Context, c cfg, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name:    "fetch",
+			summary: "fetch new webmentions and save them to the archive (default)",
+			flags:   fetchFlags,
+			run:     runFetch,
+		},
+		{
+			name:    "resync",
+			summary: "fetch all the webmentions and report (or apply) the ones added, changed or deleted since archived",
+			flags:   resyncFlags,
+			run:     runResync,
+		},
+		{
+			name:    "convert",
+			args:    "classic|jf2",
+			summary: "convert the existing archive to the classic or JF2 format",
+			flags:   archiveFlags,
+			run:     runConvert,
+		},
+		{
+			name:    "dedupe",
+			summary: "remove the duplicate webmentions from the archive, keeping a backup",
+			flags:   dedupeFlags,
+			run:     runDedupe,
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "show help for a command",
+			flags:   func(*flag.FlagSet, *cfg) {},
+			run:     runHelp,
+		},
+	}
+}
+
+// run runs the command specified in args, "fetch" if none is.
+func run(ctx context.Context, args []string) error {
+	name := defaultCommand
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := findCommand(name)
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", name)
+	}
+
+	fs := cmd.flagSet()
+	c := cfg{}
+	cmd.flags(fs, &c)
+	var config, prof, summaryFile string
+	var noNew, quiet, verbose bool
+	var logFormat string
+	var timeout time.Duration
+	if cmd.name != "help" {
+		fs.StringVar(&config, "config", "", "config `file` to read settings from")
+		fs.StringVar(&prof, "profile", "", "profile from the config file to use (all of them if omitted)")
+		fs.StringVar(&summaryFile, "summary", "", "`file` to write the summary of the run to as JSON")
+		fs.BoolVar(&noNew, "nonew", false, fmt.Sprintf("exit with status %d if there were no new webmentions", exitNoNew))
+		fs.BoolVar(&quiet, "q", false, "quiet: only log warnings and errors")
+		fs.BoolVar(&verbose, "v", false, "verbose: also log debug messages, including each request to the API")
+		fs.StringVar(&logFormat, "log", "text", "log `format`, text or json")
+		fs.DurationVar(&timeout, "timeout", 0, "give up on the whole run (all the profiles) after this `duration` without saving anything")
+	}
+	// parse errors and -h make the program exit
+	_ = fs.Parse(args)
+
+	if cmd.name != "help" {
+		logger, err := newLogger(os.Stderr, logFormat, logLevel(quiet, verbose))
+		if err != nil {
+			return err
+		}
+		slog.SetDefault(logger)
+		slog.Info("webmention.io-backup", "version", version, "command", cmd.name)
+	}
+
+	summary = runSummary{Command: cmd.name, Started: time.Now()}
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	err := runProfiles(ctx, cmd, c, fs, config, prof)
+	if err == nil && noNew && summary.New == 0 {
+		err = errNoNew
+	}
+	if summaryFile != "" {
+		if serr := summary.save(summaryFile, err); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// runProfiles runs the command with the config, or with each of the
+// selected profiles from the config file if there is one.
+func runProfiles(ctx context.Context, cmd command, c cfg, fs *flag.FlagSet, config, prof string) error {
+	if config == "" {
+		return cmd.run(ctx, c, fs.Args())
+	}
+
+	pp, err := readConfig(config)
+	if err != nil {
+		return err
+	}
+	if pp, err = selectProfiles(pp, prof); err != nil {
+		return err
+	}
+
+	// flags given on the command line override the config file
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	var failed []string
+	for _, p := range pp {
+		pc := cfg{}
+		pfs := cmd.flagSet()
+		cmd.flags(pfs, &pc)
+		p.apply(&pc)
+		for name, v := range set {
+			if f := pfs.Lookup(name); f != nil {
+				_ = f.Value.Set(v)
+			}
+		}
+
+		slog.Info("processing profile", "profile", p.name)
+		if err := cmd.run(ctx, pc, fs.Args()); err != nil {
+			slog.Error("profile failed", "profile", p.name, "err", err)
+			summary.failed(fmt.Errorf("profile %s: %w", p.name, err))
+			failed = append(failed, p.name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return failure(fmt.Errorf("failed profiles: %s", strings.Join(failed, ", ")), len(failed), len(pp))
+	}
+	return nil
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func (cmd command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s [options] %s\n\n%s\n", os.Args[0], cmd.name, cmd.args, cmd.summary)
+		var hasFlags bool
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintf(out, "\nOptions:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s [command] [options]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nRun '%s help [command]' for the command's options.\n", os.Args[0])
+}
+
+// archiveFlags defines the flags that specify where and how the archive
+// is stored.
+func archiveFlags(fs *flag.FlagSet, c *cfg) {
+	fs.StringVar(&c.filename, "f", "webmentions.json", "filename")
+	fs.StringVar(&c.database, "db", "", "SQLite database to save webmentions to instead of JSON file(s)")
+	fs.BoolVar(&c.tlo, "tlo", true, "wrap output in a top-level object (links list or feed)")
+	fs.BoolVar(&c.jsonl, "jsonl", false, "save as JSON Lines (one webmention per line), only appending new lines")
+	fs.BoolVar(&c.pretty, "p", false, "pretty-print the output (jq-style)")
+	fs.StringVar(&c.contentDir, "cd", "", "directory to look for structure in; if specified, attempts are made to save according to paths")
+	fs.Var((*list)(&c.squashLeft), "l", "`list` of top-level subdirs to drop while saving according to paths, comma-separated")
+	fs.BoolVar(&c.languages, "lang", false, "insert language into the filename before extension (for Hugo page bundles)")
+	fs.IntVar(&c.backups, "b", 0, "number of previous copies to keep for each file written")
+}
+
+func fetchFlags(fs *flag.FlagSet, c *cfg) {
+	fs.StringVar(&c.api, "api", "", "base `URL` of the webmention.io (or compatible) API, if not "+endpoint)
+	fs.StringVar(&c.token, "t", "", "API token (prefer -tf or "+tokenEnv+" environment variable, command line is visible to other users)")
+	fs.StringVar(&c.tokenFile, "tf", "", "`file` to read the API token from")
+	fs.StringVar(&c.domain, "d", "", "domain to fetch webmentions for (or a comma-separated `list` of domains to save separately)")
+	fs.StringVar(&c.target, "target", "", "only fetch webmentions of this page `URL` (or a comma-separated list of URLs, end one with * to match as a prefix), adding the ones missing from the archive")
+	fs.DurationVar(&c.requestTimeout, "request-timeout", time.Minute, "give up on a request to the API (and maybe retry it) after this `duration`, 0 to wait forever")
+	fs.Float64Var(&c.rate, "rate", 0, "limit the requests to the API to this many per second, shared by all the workers and profiles")
+	fs.IntVar(&c.workers, "workers", 1, "number of pages to fetch concurrently")
+	fs.IntVar(&c.perPage, "per-page", 0, "number of webmentions to ask for per page, if not the API default")
+	fs.BoolVar(&c.split, "split", false, "save webmentions for each domain separately")
+	fs.BoolVar(&c.useJF2, "jf2", false, "use JF2 endpoint instead of the classic one")
+	fs.BoolVar(&c.timestamp, "ts", false, "only fetch mentions newer than the last one received")
+	fs.BoolVar(&c.dryRun, "n", false, "dry run: fetch the new webmentions and report what would be saved where, without saving anything")
+	fs.StringVar(&c.planFile, "plan", "", "`file` to write the dry run report to as JSON (implies -n)")
+	duplicatesFlag(fs, c)
+	archiveFlags(fs, c)
+}
+
+func runFetch(ctx context.Context, c cfg, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+
+	token, err := apiToken(c)
+	if err != nil {
+		return err
+	}
+	c.token = token
+	if err := checkPolicy(c.duplicates); err != nil {
+		return err
+	}
+	if c.dryRun || c.planFile != "" {
+		c.plan = &plan{}
+	}
+	requests.setRate(c.rate)
+
+	dd := domains(c)
+	tt := targets(c)
+	switch {
+	case len(tt) > 0 && (c.split || len(dd) > 1):
+		err = errors.New("-target can only be used with a single archive")
+	case len(tt) > 0:
+		err = fetchTargets(ctx, c, tt)
+	case c.split && len(dd) == 0:
+		err = fetchSplit(ctx, c)
+	case c.split || len(dd) > 1:
+		err = fetchDomains(ctx, c, dd)
+	default:
+		err = fetchInto(ctx, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.plan != nil {
+		c.plan.report(os.Stdout)
+		if c.planFile != "" {
+			if err := c.plan.save(c.planFile); err != nil {
+				return err
+			}
+		}
+	}
+	slog.Info("all done")
+	return nil
+}
+
+// fetchInto fetches the new mentions and saves them to the archive.
+func fetchInto(ctx context.Context, c cfg) error {
+	url := endpointUrl(c)
+
+	// fails if the archive can't be read, so that it's not overwritten
+	store := newStore(c)
+	defer closeStore(store)
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+	since := state
+	if dd := domains(c); len(dd) == 1 {
+		since = state.forDomain(dd[0])
+	}
+
+	if c.timestamp {
+		slog.Info("will fetch webmentions received since", "timestamp", since.Timestamp)
+	} else {
+		slog.Info("will fetch webmentions since", "id", since.LastID)
+	}
+	o := fetching(c)
+	o.checkpoint = checkpointFile(c)
+	m, err := getNew(ctx, url, since.cursor(c), o)
+	if err != nil {
+		return err
+	}
+
+	if len(m) == 0 {
+		slog.Info("no new webmentions found")
+		// record the run all the same
+		if err := store.SaveState(state); err != nil {
+			return err
+		}
+		return removeCheckpoint(o.checkpoint)
+	}
+	// save everything fetched or nothing at all
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := archive(store, m); err != nil {
+		return err
+	}
+	return removeCheckpoint(o.checkpoint)
+}
+
+func resyncFlags(fs *flag.FlagSet, c *cfg) {
+	fs.BoolVar(&c.apply, "apply", false, "update the archive, not just report the changes")
+	fetchFlags(fs, c)
+}
+
+func runResync(ctx context.Context, c cfg, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	if c.planFile != "" {
+		return errors.New("-plan can not be used with resync")
+	}
+	if err := checkPolicy(c.duplicates); err != nil {
+		return err
+	}
+	// a resync without -apply is a dry run already
+	c.apply = c.apply && !c.dryRun
+
+	token, err := apiToken(c)
+	if err != nil {
+		return err
+	}
+	c.token = token
+	requests.setRate(c.rate)
+
+	dd := domains(c)
+	switch {
+	case c.target != "" && (c.split || len(dd) > 1):
+		err = errors.New("-target can only be used with a single archive")
+	case c.split && len(dd) == 0:
+		err = errors.New("resync -split needs the domains specified with -d")
+	case c.split || len(dd) > 1:
+		err = forEachDomain(ctx, c, dd, resync)
+	default:
+		err = resync(ctx, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("all done")
+	return nil
+}
+
+func runConvert(_ context.Context, c cfg, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("want exactly one format to convert to, classic or jf2")
+	}
+	if err := convert(c, args[0]); err != nil {
+		return err
+	}
+
+	slog.Info("all done")
+	return nil
+}
+
+func dedupeFlags(fs *flag.FlagSet, c *cfg) {
+	fs.BoolVar(&c.dryRun, "n", false, "dry run: only report the duplicates")
+	duplicatesFlag(fs, c)
+	archiveFlags(fs, c)
+}
+
+func duplicatesFlag(fs *flag.FlagSet, c *cfg) {
+	fs.StringVar(&c.duplicates, "duplicates", keepOld, "what to do with a webmention archived already that comes with newer content: keep (the archived one), replace, or history (replace, keeping the archived one in "+historyKey+")")
+}
+
+func runDedupe(_ context.Context, c cfg, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(args, " "))
+	}
+	if err := checkPolicy(c.duplicates); err != nil {
+		return err
+	}
+	// always keep the archive as it was before
+	if c.backups < 1 {
+		c.backups = 1
+	}
+	if err := dedupe(c, os.Stdout); err != nil {
+		return err
+	}
+
+	slog.Info("all done")
+	return nil
+}
+
+func runHelp(_ context.Context, _ cfg, args []string) error {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return nil
+	}
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	fs := cmd.flagSet()
+	cmd.flags(fs, &cfg{})
+	fs.SetOutput(os.Stdout)
+	fs.Usage()
+	return nil
+}
+
+// list is a comma-separated list flag value.
+type list []string
+
+func (l *list) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+// withTimeout returns the context with the timeout, if there is one.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
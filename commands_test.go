@@ -0,0 +1,251 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "webmentions.json")
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		args    []string
+		wantErr bool
+	}{
+		"convert":         {[]string{"convert", "-f", fn, "jf2"}, false},
+		"convert no args": {[]string{"convert", "-f", fn}, true},
+		"unknown command": {[]string{"backup"}, true},
+		"help":            {[]string{"help", "convert"}, false},
+		"help unknown":    {[]string{"help", "backup"}, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := run(context.Background(), tc.args)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+
+	mm, err := readFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mm {
+		if !m.IsJF2() {
+			t.Fatalf("mention not converted: %v", m)
+		}
+	}
+}
+
+func TestRunFetch(t *testing.T) {
+	page, err := ioutil.ReadFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var since []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiPath {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("page") == "0" {
+			since = append(since, q.Get("since_id"))
+		}
+		if q.Get("page") == "0" && q.Get("since_id") == "0" {
+			w.Write(page)
+			return
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	fn := filepath.Join(t.TempDir(), "webmentions.json")
+	for i := 0; i < 2; i++ {
+		if err := run(context.Background(), []string{"-api", ts.URL, "-f", fn}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"0", "792685"}; !reflect.DeepEqual(since, want) {
+		t.Fatalf("want since_id %v, got %v", want, since)
+	}
+	mm, err := readFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 20 {
+		t.Fatalf("want 20 mentions, got %d", len(mm))
+	}
+}
+
+func TestFetchDomainCursor(t *testing.T) {
+	var since []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "0" {
+			since = append(since, r.URL.Query().Get("since_id"))
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	// the archive shared by two domains fetched separately
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+	mm := mustParse(t, `[{"id":5,"source":"https://src.example/5","target":"https://b.example/"},{"id":10,"source":"https://src.example/10","target":"https://a.example/"}]`)
+	for _, c := range []cfg{{filename: fn}, {database: filepath.Join(dir, "wm.sqlite")}} {
+		if err := archive(newStore(c), mm); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"-api", ts.URL, "-t", "x", "-d", "b.example", "-f", c.filename}
+		if c.database != "" {
+			args = append(args, "-db", c.database)
+		}
+		if err := run(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"5", "5"}; !reflect.DeepEqual(since, want) {
+		t.Fatalf("want since_id %v, got %v", want, since)
+	}
+}
+
+func TestRunFetchDirs(t *testing.T) {
+	page, err := ioutil.ReadFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var since []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("page") == "0" {
+			since = append(since, q.Get("since_id"))
+		}
+		if q.Get("page") == "0" && q.Get("since_id") == "0" {
+			w.Write(page)
+			return
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	// every webmention has a page to go to, so none go to the root file
+	c := cfg{contentDir: t.TempDir(), filename: "webmentions.json"}
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mm {
+		if err := os.MkdirAll(filepath.Dir(pageFile(m, c)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := []string{"-api", ts.URL, "-cd", c.contentDir}
+	for i := 0; i < 2; i++ {
+		if err := run(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// without the state file, the cursor is found in the pages' files
+	if err := os.Remove(stateFile(c)); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"0", "792685", "792685"}; !reflect.DeepEqual(since, want) {
+		t.Fatalf("want since_id %v, got %v", want, since)
+	}
+}
+
+func TestFetchUnreadableArchive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "0" {
+			fmt.Fprint(w, `{"links":[{"id":1,"source":"https://src.example/","verified_date":"2021-06-07T22:21:11Z"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	fn := filepath.Join(t.TempDir(), "webmentions.json")
+	broken := []byte(`{"links":[{"id":1,`)
+	if err := ioutil.WriteFile(fn, broken, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), []string{"-api", ts.URL, "-f", fn}); err == nil {
+		t.Fatal("want error for an unreadable archive")
+	}
+	if got, _ := ioutil.ReadFile(fn); !bytes.Equal(got, broken) {
+		t.Fatalf("archive overwritten: %s", got)
+	}
+}
+
+func TestFetchCancelSavesNothing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "0" {
+			fmt.Fprint(w, `{"links":[{"id":1,"source":"https://src.example/","verified_date":"2021-06-07T22:21:11Z"}]}`)
+			return
+		}
+		// cancelled after all the pages are fetched
+		cancel()
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	fn := filepath.Join(t.TempDir(), "webmentions.json")
+	if err := run(ctx, []string{"-api", ts.URL, "-f", fn}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Fatalf("want nothing saved, got %v", err)
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	var l list
+	if err := l.Set("en,fr"); err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 2 || l.String() != "en,fr" {
+		t.Fatalf("want [en fr], got %v", l)
+	}
+}
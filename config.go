@@ -0,0 +1,169 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// profile is a set of config values, as read from the config file. Only
+// the values specified are applied.
+type profile struct {
+	Filename       *string        `toml:"filename"`
+	Database       *string        `toml:"database"`
+	API            *string        `toml:"api"`
+	Token          *string        `toml:"token"`
+	TokenFile      *string        `toml:"token_file"`
+	Domain         *string        `toml:"domain"`
+	Target         *string        `toml:"target"`
+	Workers        *int           `toml:"workers"`
+	PerPage        *int           `toml:"per_page"`
+	Rate           *float64       `toml:"rate"`
+	RequestTimeout *time.Duration `toml:"request_timeout"`
+	Split          *bool          `toml:"split"`
+	JF2            *bool          `toml:"jf2"`
+	TLO            *bool          `toml:"tlo"`
+	Pretty         *bool          `toml:"pretty"`
+	JSONL          *bool          `toml:"jsonl"`
+	ContentDir     *string        `toml:"content_dir"`
+	SquashLeft     *[]string      `toml:"squash_left"`
+	Languages      *bool          `toml:"languages"`
+	Timestamp      *bool          `toml:"timestamp"`
+	Backups        *int           `toml:"backups"`
+	Duplicates     *string        `toml:"duplicates"`
+}
+
+// configFile is the config file: the values specified at top level apply
+// to all the profiles, and each profile can override them.
+type configFile struct {
+	profile
+	Profiles map[string]profile `toml:"profiles"`
+}
+
+type namedProfile struct {
+	name string
+	profile
+}
+
+// readConfig reads the config file and returns the profiles in the order
+// they appear in the file. If the file has no profiles, its top level
+// values are returned as the only profile, named "default".
+func readConfig(fn string) ([]namedProfile, error) {
+	var f configFile
+	md, err := toml.DecodeFile(fn, &f)
+	if err != nil {
+		return nil, err
+	}
+	if u := md.Undecoded(); len(u) > 0 {
+		return nil, fmt.Errorf("%s: unknown setting %q", fn, u[0].String())
+	}
+
+	if len(f.Profiles) == 0 {
+		return []namedProfile{{"default", f.profile}}, nil
+	}
+
+	var pp []namedProfile
+	for _, k := range md.Keys() {
+		if len(k) != 2 || k[0] != "profiles" {
+			continue
+		}
+		p := f.profile
+		p.override(f.Profiles[k[1]])
+		pp = append(pp, namedProfile{k[1], p})
+	}
+	return pp, nil
+}
+
+// selectProfiles returns the named profile, or all of them if name is
+// empty or "all".
+func selectProfiles(pp []namedProfile, name string) ([]namedProfile, error) {
+	if name == "" || name == "all" {
+		return pp, nil
+	}
+	for _, p := range pp {
+		if p.name == name {
+			return []namedProfile{p}, nil
+		}
+	}
+	return nil, fmt.Errorf("no profile %q in the config file", name)
+}
+
+// override sets the values specified in o.
+func (p *profile) override(o profile) {
+	set(&p.Filename, o.Filename)
+	set(&p.Database, o.Database)
+	set(&p.API, o.API)
+	set(&p.Token, o.Token)
+	set(&p.TokenFile, o.TokenFile)
+	set(&p.Domain, o.Domain)
+	set(&p.Target, o.Target)
+	set(&p.Workers, o.Workers)
+	set(&p.PerPage, o.PerPage)
+	set(&p.Rate, o.Rate)
+	set(&p.RequestTimeout, o.RequestTimeout)
+	set(&p.Split, o.Split)
+	set(&p.JF2, o.JF2)
+	set(&p.TLO, o.TLO)
+	set(&p.Pretty, o.Pretty)
+	set(&p.JSONL, o.JSONL)
+	set(&p.ContentDir, o.ContentDir)
+	set(&p.SquashLeft, o.SquashLeft)
+	set(&p.Languages, o.Languages)
+	set(&p.Timestamp, o.Timestamp)
+	set(&p.Backups, o.Backups)
+	set(&p.Duplicates, o.Duplicates)
+}
+
+// apply sets the config values specified in the profile.
+func (p profile) apply(c *cfg) {
+	get(&c.filename, p.Filename)
+	get(&c.database, p.Database)
+	get(&c.api, p.API)
+	get(&c.token, p.Token)
+	get(&c.tokenFile, p.TokenFile)
+	get(&c.domain, p.Domain)
+	get(&c.target, p.Target)
+	get(&c.workers, p.Workers)
+	get(&c.perPage, p.PerPage)
+	get(&c.rate, p.Rate)
+	get(&c.requestTimeout, p.RequestTimeout)
+	get(&c.split, p.Split)
+	get(&c.useJF2, p.JF2)
+	get(&c.tlo, p.TLO)
+	get(&c.pretty, p.Pretty)
+	get(&c.jsonl, p.JSONL)
+	get(&c.contentDir, p.ContentDir)
+	get(&c.squashLeft, p.SquashLeft)
+	get(&c.languages, p.Languages)
+	get(&c.timestamp, p.Timestamp)
+	get(&c.backups, p.Backups)
+	get(&c.duplicates, p.Duplicates)
+}
+
+func set[T any](p **T, v *T) {
+	if v != nil {
+		*p = v
+	}
+}
+
+func get[T any](p *T, v *T) {
+	if v != nil {
+		*p = *v
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `token = "t0K3n"
+tlo = false
+
+[profiles.blog]
+domain = "example.org"
+content_dir = "site/content"
+squash_left = ["en", "ru"]
+languages = true
+
+[profiles.notes]
+domain = "notes.example.org"
+token = "n0t3s"
+filename = "notes.json"
+request_timeout = "30s"
+rate = 2
+duplicates = "history"
+`
+
+func TestReadConfig(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(fn, []byte(testConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pp, err := readConfig(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []cfg{
+		{token: "t0K3n", domain: "example.org", contentDir: "site/content", squashLeft: []string{"en", "ru"}, languages: true},
+		{token: "n0t3s", domain: "notes.example.org", filename: "notes.json", requestTimeout: 30 * time.Second, rate: 2, duplicates: keepHistory},
+	}
+	if len(pp) != len(want) {
+		t.Fatalf("want %d profiles, got %d", len(want), len(pp))
+	}
+	for i, p := range pp {
+		got := cfg{tlo: true}
+		p.apply(&got)
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Fatalf("profile %s:\nwant %+v\n got %+v", p.name, want[i], got)
+		}
+	}
+
+	if _, err := selectProfiles(pp, "nosuchprofile"); err == nil {
+		t.Fatal("want error for non-existent profile")
+	}
+	if got, _ := selectProfiles(pp, "notes"); len(got) != 1 || got[0].name != "notes" {
+		t.Fatalf("wrong profile selected: %v", got)
+	}
+}
+
+func TestReadConfigErr(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(fn, []byte(`tokn = "typo"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readConfig(fn); err == nil {
+		t.Fatal("want error for unknown setting")
+	}
+}
+
+func TestRunProfiles(t *testing.T) {
+	dir := t.TempDir()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config strings.Builder
+	for _, name := range []string{"one", "two"} {
+		fn := filepath.Join(dir, name+".json")
+		if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&config, "[profiles.%s]\nfilename = %q\n", name, fn)
+	}
+	cf := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(cf, []byte(config.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), []string{"convert", "-config", cf, "-tlo=false", "jf2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"one", "two"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// -tlo=false from the command line applies to every profile
+		if !strings.HasPrefix(string(got), `[{`) {
+			t.Fatalf("%s: want array of mentions, got %.20s", name, got)
+		}
+	}
+
+	if err := run(context.Background(), []string{"convert", "-config", cf, "-profile", "three", "jf2"}); err == nil {
+		t.Fatal("want error for non-existent profile")
+	}
+}
+
+func TestRunProfilesTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never answers
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	var config strings.Builder
+	for _, name := range []string{"one", "two"} {
+		fmt.Fprintf(&config, "[profiles.%s]\nfilename = %q\n", name, filepath.Join(dir, name+".json"))
+	}
+	cf := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(cf, []byte(config.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err := run(context.Background(), []string{"-config", cf, "-api", ts.URL, "-t", "x", "-request-timeout", "0", "-timeout", "300ms"})
+	if err == nil {
+		t.Fatal("want error on timeout")
+	}
+	// the timeout is for the whole run, not for each of the profiles
+	if d := time.Since(start); d > 550*time.Millisecond {
+		t.Fatalf("want the run to stop after 300ms, took %s", d)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// convert rewrites the whole archive (the single file, or all the files in
+// the content directory) in the specified format, classic or JF2.
+func convert(c cfg, format string) error {
+	switch format {
+	case "classic":
+		c.useJF2 = false
+	case "jf2":
+		c.useJF2 = true
+	default:
+		return fmt.Errorf("unknown format %q, want classic or jf2", format)
+	}
+
+	if c.database != "" {
+		return fmt.Errorf("converting an SQLite database is not supported")
+	}
+	if c.contentDir == "" {
+		return convertFile(c)
+	}
+
+	return walkArchive(c, func(path string) error {
+		fc := c
+		fc.filename = path
+		return convertFile(fc)
+	})
+}
+
+func convertFile(c cfg) error {
+	mm, f, err := readArchive(c.filename)
+	if err != nil {
+		return err
+	}
+
+	for i, m := range mm {
+		if c.useJF2 {
+			mm[i] = m.ToJF2()
+		} else {
+			mm[i] = m.ToClassic()
+		}
+	}
+
+	c.jsonl = c.jsonl || f.lines
+	if err := writeFile(mm, c); err != nil {
+		return err
+	}
+	slog.Info("converted webmentions", "count", len(mm), "file", c.filename)
+	return nil
+}
+
+// isArchiveFile tells whether a file with this name can be written by the
+// content directory store.
+func isArchiveFile(name string, c cfg) bool {
+	if name == c.filename {
+		return true
+	}
+	if !c.languages {
+		return false
+	}
+	ext := filepath.Ext(c.filename)
+	base := strings.TrimSuffix(c.filename, ext)
+	for _, pref := range c.squashLeft {
+		if pref != "" && name == strings.Join([]string{base, pref, strings.TrimPrefix(ext, ".")}, ".") {
+			return true
+		}
+	}
+	return false
+}
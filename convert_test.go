@@ -0,0 +1,86 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "posts", "webmentions.json")
+	lang := filepath.Join(dir, "posts", "webmentions.en.json")
+	other := filepath.Join(dir, "other.json")
+	if err := os.MkdirAll(filepath.Dir(page), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jf, err := readFile(filepath.Join("testdata", "jf2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{page, lang, other} {
+		if err := writeFile(append(mm[:3:3], jf...), cfg{filename: fn, tlo: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := cfg{contentDir: dir, filename: "webmentions.json", squashLeft: []string{"en"}, languages: true, tlo: true}
+	if err := convert(c, "jf2"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fn := range []string{page, lang} {
+		got, err := readFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range got {
+			if !m.IsJF2() {
+				t.Fatalf("%s: mention not converted to JF2: %v", fn, m)
+			}
+		}
+		b, _ := ioutil.ReadFile(fn)
+		if !strings.HasPrefix(string(b), `{"type":"feed"`) {
+			t.Fatalf("%s: no JF2 feed top-level object", fn)
+		}
+	}
+	if b, _ := ioutil.ReadFile(other); !strings.HasPrefix(string(b), `{"links"`) {
+		t.Fatalf("%s: file not in content tree was converted", other)
+	}
+
+	if err := convert(cfg{filename: other}, "classic"); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := readFile(other)
+	for _, m := range got {
+		if m.IsJF2() {
+			t.Fatalf("mention not converted to classic: %v", m)
+		}
+	}
+
+	if err := convert(c, "xml"); err == nil {
+		t.Fatal("want error for unknown format")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+// What to do when a mention already archived comes again with different
+// content (i.e. it was re-verified and the source page has changed).
+const (
+	keepOld     = "keep"
+	replaceOld  = "replace"
+	keepHistory = "history"
+)
+
+// historyKey holds the earlier versions of a mention, oldest first.
+const historyKey = "_history"
+
+// checkPolicy returns an error if the duplicates policy is not known.
+func checkPolicy(p string) error {
+	switch p {
+	case "", keepOld, replaceOld, keepHistory:
+		return nil
+	}
+	return fmt.Errorf("unknown duplicates policy %q, want %s, %s or %s", p, keepOld, replaceOld, keepHistory)
+}
+
+// sameMention tells whether the mentions are the same webmention: by ID
+// if both have one, by source and target otherwise.
+func sameMention(ma, mb mention.Mention) bool {
+	if ida, idb := ma.ID(), mb.ID(); ida != 0 && idb != 0 {
+		return ida == idb
+	}
+	return ma.Source() != "" && ma.Source() == mb.Source() && ma.Target() == mb.Target()
+}
+
+// sameContent tells whether the mentions are the same, not counting the
+// earlier versions kept.
+func sameContent(ma, mb mention.Mention) bool {
+	return reflect.DeepEqual(withoutHistory(ma), withoutHistory(mb))
+}
+
+// resolve returns what to archive when m is a duplicate of the archived
+// mention a, and whether that differs from a.
+func resolve(a, m mention.Mention, policy string) (mention.Mention, bool) {
+	if (policy != replaceOld && policy != keepHistory) || sameContent(a, m) || m.Received().Before(a.Received()) {
+		return a, false
+	}
+
+	r := withoutHistory(m)
+	hist, _ := a[historyKey].([]interface{})
+	hist = append([]interface{}{}, hist...)
+	if policy == keepHistory {
+		hist = append(hist, map[string]interface{}(withoutHistory(a)))
+	}
+	if len(hist) > 0 {
+		r[historyKey] = hist
+	}
+	return r, true
+}
+
+// merge adds the mentions to the archived ones, resolving the duplicates
+// according to the policy. It returns all the mentions, with the new ones
+// at the end, and the numbers of new and updated mentions.
+func merge(existing, mm []mention.Mention, policy string) (all []mention.Mention, added, updated int) {
+	all = append([]mention.Mention{}, existing...)
+	x := newIndex()
+	for i, m := range all {
+		x.add(m, i)
+	}
+	changed := map[int]bool{}
+	for _, m := range mm {
+		i := x.find(m)
+		if i < 0 {
+			x.add(m, len(all))
+			all = append(all, m)
+			added++
+			continue
+		}
+		var ok bool
+		if all[i], ok = resolve(all[i], m, policy); ok && i < len(existing) && !changed[i] {
+			changed[i] = true
+			updated++
+		}
+	}
+	return
+}
+
+// index finds the mentions the same way sameMention compares them, by ID
+// or by source and target, without going through all of them.
+type index struct {
+	byID map[int]int
+	// all the mentions, and the ones without IDs
+	byURL, noID map[[2]string]int
+}
+
+func newIndex() *index {
+	return &index{byID: map[int]int{}, byURL: map[[2]string]int{}, noID: map[[2]string]int{}}
+}
+
+// add records the mention found at i, unless the same one is there already.
+func (x *index) add(m mention.Mention, i int) {
+	id, key := m.ID(), [2]string{m.Source(), m.Target()}
+	if _, ok := x.byID[id]; id != 0 && !ok {
+		x.byID[id] = i
+	}
+	if m.Source() == "" {
+		return
+	}
+	if _, ok := x.byURL[key]; !ok {
+		x.byURL[key] = i
+	}
+	if _, ok := x.noID[key]; id == 0 && !ok {
+		x.noID[key] = i
+	}
+}
+
+// find returns where the same mention was found, or -1.
+func (x *index) find(m mention.Mention) int {
+	id, key := m.ID(), [2]string{m.Source(), m.Target()}
+	if id != 0 {
+		if i, ok := x.byID[id]; ok {
+			return i
+		}
+	}
+	if m.Source() == "" {
+		return -1
+	}
+	urls := x.byURL
+	if id != 0 {
+		// a mention with ID is only the same as the one without
+		urls = x.noID
+	}
+	if i, ok := urls[key]; ok {
+		return i
+	}
+	return -1
+}
+
+// withoutHistory returns a copy of the mention without its earlier
+// versions.
+func withoutHistory(m mention.Mention) mention.Mention {
+	r := make(mention.Mention, len(m))
+	for k, v := range m {
+		if k != historyKey {
+			r[k] = v
+		}
+	}
+	return r
+}
+
+// archiveFile is a file of the archive being deduplicated.
+type archiveFile struct {
+	path   string
+	format archiveFormat
+	kept   []mention.Mention
+	dups   []mention.Mention
+	// changed is set if the file is to be rewritten
+	changed bool
+}
+
+// dedupe removes the duplicate mentions from the archive (the single file,
+// or all the files in the content directory), keeping one of each
+// according to the policy, and reports the ones removed. A mention that is
+// both in the file of its page and in the file in the root of the content
+// directory is kept in the former.
+func dedupe(c cfg, w io.Writer) error {
+	if c.database != "" {
+		return fmt.Errorf("an SQLite database can not have duplicates")
+	}
+
+	paths := []string{c.filename}
+	if c.contentDir != "" {
+		root := filepath.Join(c.contentDir, c.filename)
+		paths = nil
+		if err := walkArchive(c, func(path string) error {
+			if path != root {
+				paths = append(paths, path)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if _, err := os.Stat(root); err == nil {
+			paths = append(paths, root)
+		}
+	}
+
+	// where each of the mentions kept is
+	type ref struct{ file, i int }
+	var refs []ref
+	x := newIndex()
+	files := make([]*archiveFile, len(paths))
+	for fi, path := range paths {
+		mm, format, err := readArchive(path)
+		if err != nil {
+			return err
+		}
+		f := &archiveFile{path: path, format: format}
+		files[fi] = f
+		for _, m := range mm {
+			g := x.find(m)
+			if g < 0 {
+				x.add(m, len(refs))
+				refs = append(refs, ref{fi, len(f.kept)})
+				f.kept = append(f.kept, m)
+				continue
+			}
+			r := refs[g]
+			kf := files[r.file]
+			var ok bool
+			if kf.kept[r.i], ok = resolve(kf.kept[r.i], m, c.duplicates); ok {
+				kf.changed = true
+			}
+			f.dups = append(f.dups, m)
+			f.changed = true
+		}
+	}
+
+	var total int
+	for _, f := range files {
+		if len(f.dups) == 0 {
+			continue
+		}
+		total += len(f.dups)
+		fmt.Fprintf(w, "%s: %d duplicate webmentions\n", f.path, len(f.dups))
+		for _, m := range f.dups {
+			fmt.Fprintf(w, "- %d %s -> %s\n", m.ID(), m.Source(), m.Target())
+		}
+	}
+	if !c.dryRun {
+		for _, f := range files {
+			if !f.changed {
+				continue
+			}
+			fc := f.format.rewrite(c)
+			fc.filename = f.path
+			if err := writeFile(f.kept, fc); err != nil {
+				return err
+			}
+			slog.Info("removed duplicate webmentions", "count", len(f.dups), "file", f.path)
+		}
+	}
+	reportDuplicates(w, total, c.dryRun)
+	return nil
+}
+
+func reportDuplicates(w io.Writer, n int, dryRun bool) {
+	switch {
+	case n == 0:
+		fmt.Fprintln(w, "No duplicate webmentions found.")
+	case dryRun:
+		fmt.Fprintf(w, "Dry run, would remove %d duplicate webmentions.\n", n)
+	default:
+		fmt.Fprintf(w, "Removed %d duplicate webmentions.\n", n)
+	}
+}
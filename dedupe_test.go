@@ -0,0 +1,306 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+func TestSameMention(t *testing.T) {
+	tests := map[string]struct {
+		a, b mention.Mention
+		want bool
+	}{
+		"same ID, re-verified": {
+			mention.Mention{"id": 1.0, "source": "https://a.example/", "verified_date": "2021-06-07T22:21:11Z"},
+			mention.Mention{"id": 1.0, "source": "https://a.example/", "verified_date": "2021-06-08T10:00:00Z"},
+			true,
+		},
+		"classic and JF2": {
+			mention.Mention{"id": 1.0, "source": "https://a.example/"},
+			mention.Mention{"wm-id": 1.0, "wm-source": "https://a.example/"},
+			true,
+		},
+		"different IDs": {
+			mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/"},
+			mention.Mention{"id": 2.0, "source": "https://a.example/", "target": "https://example.org/"},
+			false,
+		},
+		"no ID, same source and target": {
+			mention.Mention{"source": "https://a.example/", "target": "https://example.org/"},
+			mention.Mention{"id": 2.0, "source": "https://a.example/", "target": "https://example.org/"},
+			true,
+		},
+		"no ID, different target": {
+			mention.Mention{"source": "https://a.example/", "target": "https://example.org/"},
+			mention.Mention{"source": "https://a.example/", "target": "https://example.org/post/"},
+			false,
+		},
+		"no source": {
+			mention.Mention{"timestamp": "2021-06-07T22:21:11Z"},
+			mention.Mention{"timestamp": "2021-06-07T22:21:11Z"},
+			false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := sameMention(tc.a, tc.b); got != tc.want {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	old := mention.Mention{"id": 1.0, "source": "https://a.example/", "verified_date": "2021-06-07T22:21:11Z", "content": "old"}
+	edited := mention.Mention{"id": 1.0, "source": "https://a.example/", "verified_date": "2021-06-08T10:00:00Z", "content": "edited"}
+	stale := mention.Mention{"id": 1.0, "source": "https://a.example/", "verified_date": "2021-06-01T10:00:00Z", "content": "stale"}
+	other := mention.Mention{"id": 2.0, "source": "https://b.example/", "verified_date": "2021-06-08T11:00:00Z"}
+
+	tests := map[string]struct {
+		policy  string
+		mm      []mention.Mention
+		content string
+		history int
+		added   int
+		updated int
+	}{
+		"keep":          {keepOld, []mention.Mention{edited, other}, "old", 0, 1, 0},
+		"default":       {"", []mention.Mention{edited}, "old", 0, 0, 0},
+		"replace":       {replaceOld, []mention.Mention{edited, other}, "edited", 0, 1, 1},
+		"history":       {keepHistory, []mention.Mention{edited}, "edited", 1, 0, 1},
+		"same content":  {keepHistory, []mention.Mention{old}, "old", 0, 0, 0},
+		"older content": {replaceOld, []mention.Mention{stale}, "old", 0, 0, 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			all, added, updated := merge([]mention.Mention{old}, tc.mm, tc.policy)
+			if added != tc.added || updated != tc.updated {
+				t.Fatalf("want %d added and %d updated, got %d and %d", tc.added, tc.updated, added, updated)
+			}
+			if len(all) != 1+tc.added {
+				t.Fatalf("want %d mentions, got %d", 1+tc.added, len(all))
+			}
+			if got := all[0]["content"]; got != tc.content {
+				t.Fatalf("want content %q, got %q", tc.content, got)
+			}
+			hist, _ := all[0][historyKey].([]interface{})
+			if len(hist) != tc.history {
+				t.Fatalf("want %d earlier versions, got %v", tc.history, hist)
+			}
+		})
+	}
+}
+
+func TestDuplicatesHistory(t *testing.T) {
+	v1 := mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/", "verified_date": "2021-06-07T22:21:11Z", "content": "v1"}
+	v2 := mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/", "verified_date": "2021-06-08T10:00:00Z", "content": "v2"}
+	v3 := mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/", "verified_date": "2021-06-09T10:00:00Z", "content": "v3"}
+
+	dir := t.TempDir()
+	for name, c := range map[string]cfg{
+		"file":     {filename: filepath.Join(dir, "webmentions.json"), duplicates: keepHistory},
+		"jsonl":    {filename: filepath.Join(dir, "webmentions.jsonl"), jsonl: true, duplicates: keepHistory},
+		"database": {database: filepath.Join(dir, "wm.sqlite"), duplicates: keepHistory},
+		"content":  {contentDir: t.TempDir(), filename: "webmentions.json", duplicates: keepHistory},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, m := range []mention.Mention{v1, v2, v2, v3} {
+				if err := newStore(c).Append([]mention.Mention{m}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mm, err := newStore(c).Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mm) != 1 || mm[0]["content"] != "v3" {
+				t.Fatalf("want v3 only, got %v", mm)
+			}
+			hist, _ := mm[0][historyKey].([]interface{})
+			if len(hist) != 2 {
+				t.Fatalf("want 2 earlier versions, got %v", hist)
+			}
+			for i, want := range []string{"v1", "v2"} {
+				if got := hist[i].(map[string]interface{})["content"]; got != want {
+					t.Fatalf("want version %d to be %s, got %v", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	mm := []mention.Mention{
+		{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/"},
+		{"source": "https://b.example/", "target": "https://example.org/"},
+		{"id": 3.0, "source": "https://c.example/", "target": "https://example.org/"},
+	}
+	x := newIndex()
+	for i, m := range mm {
+		x.add(m, i)
+	}
+
+	tests := []mention.Mention{
+		{"wm-id": 1.0, "wm-source": "https://a.example/"},
+		{"id": 2.0, "source": "https://b.example/", "target": "https://example.org/"},
+		{"source": "https://c.example/", "target": "https://example.org/"},
+		{"id": 4.0, "source": "https://c.example/", "target": "https://example.org/"},
+		{"timestamp": "2021-06-07T22:21:11Z"},
+	}
+	for _, m := range tests {
+		want := -1
+		for i, e := range mm {
+			if sameMention(e, m) {
+				want = i
+				break
+			}
+		}
+		if got := x.find(m); got != want {
+			t.Fatalf("%v: want %d, got %d", m, want, got)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same mentions appended again, one of them as JF2
+	dups := append(append([]mention.Mention{}, mm...), mm[0], mm[1].ToJF2())
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+	if err := writeFile(dups, cfg{filename: fn}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), []string{"dedupe", "-n", "-f", fn}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := readFile(fn); len(got) != len(dups) {
+		t.Fatalf("dry run: want %d mentions left, got %d", len(dups), len(got))
+	}
+
+	if err := run(context.Background(), []string{"dedupe", "-f", fn}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(mm) {
+		t.Fatalf("want %d mentions, got %d", len(mm), len(got))
+	}
+	if !reflect.DeepEqual(got, mm) {
+		t.Fatal("wrong mentions kept")
+	}
+	backup, err := readFile(fn + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup) != len(dups) {
+		t.Fatalf("want %d mentions in the backup, got %d", len(dups), len(backup))
+	}
+}
+
+func TestDedupeKeepsFormat(t *testing.T) {
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dups := append(append([]mention.Mention{}, mm...), mm[0])
+
+	tests := map[string]struct {
+		c    cfg
+		want archiveFormat
+	}{
+		"classic": {cfg{tlo: true}, archiveFormat{tlo: true}},
+		"jf2":     {cfg{tlo: true, useJF2: true}, archiveFormat{tlo: true, jf2: true}},
+		"array":   {cfg{}, archiveFormat{}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := tc.c
+			c.filename = filepath.Join(t.TempDir(), "webmentions.json")
+			if err := writeFile(dups, c); err != nil {
+				t.Fatal(err)
+			}
+			if err := run(context.Background(), []string{"dedupe", "-f", c.filename}); err != nil {
+				t.Fatal(err)
+			}
+			got, f, err := readArchive(c.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(mm) {
+				t.Fatalf("want %d mentions, got %d", len(mm), len(got))
+			}
+			if f != tc.want {
+				t.Fatalf("want the file written as %+v, got %+v", tc.want, f)
+			}
+		})
+	}
+}
+
+func TestDedupeDirs(t *testing.T) {
+	c := cfg{contentDir: t.TempDir(), filename: "webmentions.json"}
+	m := mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/post/", "verified_date": "2021-06-07T22:21:11Z"}
+	// the old rules saved a re-verified mention again
+	rv := mention.Mention{"id": 1.0, "source": "https://a.example/", "target": "https://example.org/post/", "verified_date": "2021-06-08T10:00:00Z"}
+	fn := filepath.Join(c.contentDir, "post", c.filename)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile([]mention.Mention{m, rv}, cfg{filename: fn}); err != nil {
+		t.Fatal(err)
+	}
+	// and saved it to the root file when the page was not there yet
+	root := filepath.Join(c.contentDir, c.filename)
+	if err := writeFile([]mention.Mention{m}, cfg{filename: root, tlo: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), []string{"dedupe", "-cd", c.contentDir, "-duplicates", "replace"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], rv) {
+		t.Fatalf("want the re-verified mention only, got %v", got)
+	}
+	if _, err := os.Stat(fn + ".1"); err != nil {
+		t.Fatalf("no backup: %v", err)
+	}
+	if got, err := readFile(root); err != nil || len(got) != 0 {
+		t.Fatalf("want the root file emptied, got %v (%v)", got, err)
+	}
+
+	if err := run(context.Background(), []string{"dedupe", "-db", filepath.Join(c.contentDir, "wm.sqlite")}); err == nil {
+		t.Fatal("want error for a database")
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+// domainPlaceholder is replaced with the domain name in the filename,
+// content directory or database name when each domain is saved separately.
+const domainPlaceholder = "{domain}"
+
+// domains returns the list of domains specified in the config.
+func domains(c cfg) (dd []string) {
+	for _, d := range strings.Split(c.domain, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			dd = append(dd, d)
+		}
+	}
+	return
+}
+
+// domainTemplate returns the config with the domain placeholder in the
+// path of the archive. If the placeholder is not there already, it is
+// inserted into the database or file name before the extension, or
+// appended to the content directory as a subdirectory.
+func domainTemplate(c cfg) cfg {
+	switch {
+	case c.database != "":
+		if !strings.Contains(c.database, domainPlaceholder) {
+			c.database = insertBeforeExt(c.database, domainPlaceholder)
+		}
+	case c.contentDir != "":
+		if !strings.Contains(c.contentDir, domainPlaceholder) {
+			c.contentDir = filepath.Join(c.contentDir, domainPlaceholder)
+		}
+	default:
+		if !strings.Contains(c.filename, domainPlaceholder) {
+			c.filename = insertBeforeExt(c.filename, domainPlaceholder)
+		}
+	}
+	return c
+}
+
+// forDomain returns the config to archive the domain's mentions with.
+func forDomain(c cfg, d string) cfg {
+	c = domainTemplate(c)
+	c.database = strings.ReplaceAll(c.database, domainPlaceholder, d)
+	c.contentDir = strings.ReplaceAll(c.contentDir, domainPlaceholder, d)
+	c.filename = strings.ReplaceAll(c.filename, domainPlaceholder, d)
+	c.domain = d
+	return c
+}
+
+// archivedDomains returns the domains that already have archives.
+func archivedDomains(c cfg) ([]string, error) {
+	c = domainTemplate(c)
+	var tpl string
+	switch {
+	case c.database != "":
+		tpl = c.database
+	case strings.Contains(c.contentDir, domainPlaceholder):
+		tpl = c.contentDir
+	default:
+		tpl = filepath.Join(c.contentDir, c.filename)
+	}
+	tpl = filepath.Clean(tpl)
+
+	mm, err := filepath.Glob(strings.Replace(tpl, domainPlaceholder, "*", 1))
+	if err != nil {
+		return nil, err
+	}
+
+	i := strings.Index(tpl, domainPlaceholder)
+	prefix, suffix := tpl[:i], tpl[i+len(domainPlaceholder):]
+	var dd []string
+	for _, m := range mm {
+		d := strings.TrimSuffix(strings.TrimPrefix(m, prefix), suffix)
+		if d != "" && !strings.ContainsRune(d, filepath.Separator) {
+			dd = append(dd, d)
+		}
+	}
+	return dd, nil
+}
+
+// fetchDomains fetches and archives the mentions for each of the domains
+// separately.
+func fetchDomains(ctx context.Context, c cfg, dd []string) error {
+	return forEachDomain(ctx, c, dd, fetchInto)
+}
+
+// forEachDomain runs fn with the config for each of the domains, carrying
+// on if some of them fail.
+func forEachDomain(ctx context.Context, c cfg, dd []string, fn func(context.Context, cfg) error) error {
+	var failed []string
+	for _, d := range dd {
+		slog.Info("processing domain", "domain", d)
+		if err := fn(ctx, forDomain(c, d)); err != nil {
+			slog.Error("domain failed", "domain", d, "err", err)
+			summary.failed(fmt.Errorf("domain %s: %w", d, err))
+			failed = append(failed, d)
+		}
+	}
+	if len(failed) > 0 {
+		return failure(fmt.Errorf("failed domains: %s", strings.Join(failed, ", ")), len(failed), len(dd))
+	}
+	return nil
+}
+
+// fetchSplit fetches the mentions for all the domains at once and
+// archives them separately for each domain found in the mentions' targets.
+func fetchSplit(ctx context.Context, c cfg) error {
+	known, err := archivedDomains(c)
+	if err != nil {
+		return err
+	}
+
+	stores := map[string]Store{}
+	defer func() {
+		for _, s := range stores {
+			closeStore(s)
+		}
+	}()
+	states := map[string]syncState{}
+	var since syncState
+	for i, d := range known {
+		s := newStore(forDomain(c, d))
+		stores[d] = s
+		st, err := s.LoadState()
+		if err != nil {
+			return err
+		}
+		states[d] = st
+		if i == 0 || st.LastID < since.LastID {
+			since.LastID = st.LastID
+		}
+		if i == 0 || st.Timestamp.Before(since.Timestamp) {
+			since.Timestamp = st.Timestamp
+		}
+	}
+	slog.Info("found archives for domains", "count", len(known))
+
+	o := fetching(c)
+	o.checkpoint = checkpointFile(c)
+	m, err := getNew(ctx, endpointUrl(c), since.cursor(c), o)
+	if err != nil {
+		return err
+	}
+
+	byDomain := map[string][]mention.Mention{}
+	for _, mn := range m {
+		d := domainOf(mn)
+		if st, ok := states[d]; ok && st.covers(mn, c) {
+			continue
+		}
+		byDomain[d] = append(byDomain[d], mn)
+	}
+	if len(byDomain) == 0 {
+		slog.Info("no new webmentions found")
+		return removeCheckpoint(o.checkpoint)
+	}
+
+	// save everything fetched or nothing at all
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dd := make([]string, 0, len(byDomain))
+	for d := range byDomain {
+		dd = append(dd, d)
+	}
+	sort.Strings(dd)
+
+	for _, d := range dd {
+		s, ok := stores[d]
+		switch {
+		case ok:
+		case d == "":
+			slog.Warn("some webmentions have no target domain, saving them to the common archive")
+			s = newStore(c)
+		default:
+			s = newStore(forDomain(c, d))
+		}
+		stores[d] = s
+		slog.Info("new webmentions for domain", "domain", d, "count", len(byDomain[d]))
+		if err := archive(s, byDomain[d]); err != nil {
+			return err
+		}
+	}
+	return removeCheckpoint(o.checkpoint)
+}
+
+// domainOf returns the domain of the mention's target.
+func domainOf(m mention.Mention) string {
+	u, err := url.Parse(m.Target())
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func insertBeforeExt(fn, s string) string {
+	ext := filepath.Ext(fn)
+	return strings.TrimSuffix(fn, ext) + "." + s + ext
+}
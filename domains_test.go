@@ -0,0 +1,112 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestForDomain(t *testing.T) {
+	tt := map[string]struct {
+		config cfg
+		want   cfg
+	}{
+		"file":        {cfg{filename: "wm.json"}, cfg{filename: "wm.example.org.json"}},
+		"placeholder": {cfg{filename: "{domain}/wm.json"}, cfg{filename: "example.org/wm.json"}},
+		"content dir": {cfg{filename: "wm.json", contentDir: "sites"}, cfg{filename: "wm.json", contentDir: filepath.Join("sites", "example.org")}},
+		"database":    {cfg{filename: "wm.json", database: "wm.sqlite"}, cfg{filename: "wm.json", database: "wm.example.org.sqlite"}},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got := forDomain(tc.config, "example.org")
+			tc.want.domain = "example.org"
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchSplit(t *testing.T) {
+	var page string
+	for i, d := range []string{"one.example", "two.example", "one.example", "two.example"} {
+		if page != "" {
+			page += ","
+		}
+		page += fmt.Sprintf(`{"id":%d,"source":"https://src.example/%d","target":"https://%s/post/","verified_date":"2021-06-07T22:21:1%dZ"}`, 10+i, i, d, i)
+	}
+
+	var since []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		since = append(since, r.URL.Query().Get("since_id"))
+		// always return everything to make sure nothing is duplicated
+		fmt.Fprintf(w, `{"links":[%s]}`, page)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	c := cfg{api: ts.URL, filename: filepath.Join(dir, "wm.json"), split: true}
+	if err := fetchSplit(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	dd, err := archivedDomains(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(dd)
+	if want := []string{"one.example", "two.example"}; !reflect.DeepEqual(dd, want) {
+		t.Fatalf("want domains %v, got %v", want, dd)
+	}
+
+	// one domain gets behind, i.e. its archive was restored from backup
+	if err := writeFile(nil, forDomain(c, "one.example")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fetchSplit(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0", "0"}; !reflect.DeepEqual(since, want) {
+		t.Fatalf("want since_id %v, got %v", want, since)
+	}
+
+	for _, d := range dd {
+		mm, err := readFile(forDomain(c, d).filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mm) != 2 {
+			t.Fatalf("%s: want 2 mentions, got %d", d, len(mm))
+		}
+		for _, m := range mm {
+			if domainOf(m) != d {
+				t.Fatalf("%s: mention for %s", d, domainOf(m))
+			}
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+// retries governs how transient API failures are retried.
+var retries = struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}{
+	attempts: 5,
+	base:     time.Second,
+	max:      time.Minute,
+}
+
+// limiter spaces the requests out to keep under the rate limit.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// requests limits the rate of all the requests made during a run.
+var requests limiter
+
+// setRate sets the limit in requests per second, 0 for no limit.
+func (l *limiter) setRate(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.interval = 0
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+}
+
+// wait waits for the turn to make a request.
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	t := l.next
+	if t.Before(now) {
+		t = now
+	}
+	l.next = t.Add(l.interval)
+	l.mu.Unlock()
+
+	d := t.Sub(now)
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// statusError is returned when the API responds with a non-2xx status.
+type statusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.url, e.status)
+}
+
+// fetchOptions are the settings for fetching the pages.
+type fetchOptions struct {
+	workers int
+	// timeout is for each of the requests
+	timeout time.Duration
+	// checkpoint is the file to keep the pages fetched so far in, if any
+	checkpoint string
+}
+
+func fetching(c cfg) fetchOptions {
+	return fetchOptions{workers: c.workers, timeout: c.requestTimeout}
+}
+
+func getPage(ctx context.Context, uri string, timeout time.Duration) (mm []mention.Mention, err error) {
+	for attempt := 0; ; attempt++ {
+		var wait time.Duration
+		var retry bool
+		mm, wait, retry, err = tryPage(ctx, uri, timeout)
+		if err == nil || !retry || attempt >= retries.attempts || ctx.Err() != nil {
+			return
+		}
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		slog.Warn("request failed, retrying", "err", err, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// tryPage makes a single attempt at fetching a page. When the attempt
+// fails, retry tells whether the failure is worth retrying, and wait is
+// how long the server asked us to wait before doing so (if it did).
+func tryPage(ctx context.Context, uri string, timeout time.Duration) (mm []mention.Mention, wait time.Duration, retry bool, err error) {
+	if err = requests.wait(ctx); err != nil {
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.DefaultClient.Do(req)
+	}
+	if err != nil {
+		retry = isTransient(err)
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			ue.URL = redact(ue.URL)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = &statusError{url: redact(uri), code: resp.StatusCode, status: resp.Status}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			retry = true
+			wait = retryAfter(resp.Header.Get("Retry-After"))
+		}
+		return
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		retry = isTransient(err)
+		return
+	}
+	if mm, err = parsePage(b); err != nil {
+		err = fmt.Errorf("%s: %w", redact(uri), err)
+	}
+	return
+}
+
+// redact returns the URL with the API token hidden, safe to be printed.
+func redact(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "(unparseable URL)"
+	}
+	q := pu.Query()
+	if q.Get("token") == "" {
+		return u
+	}
+	q.Set("token", "REDACTED")
+	pu.RawQuery = q.Encode()
+	return pu.String()
+}
+
+// isTransient tells whether the request failure can go away on retrying:
+// a timeout, or the connection refused, reset or closed early.
+func isTransient(err error) bool {
+	// every error from the client is a *url.Error, itself a net.Error
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		err = ue.Err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryAfter parses the value of a Retry-After header, which can be
+// either a number of seconds or an HTTP date.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func backoff(attempt int) time.Duration {
+	d := retries.base
+	for i := 0; i < attempt && d < retries.max; i++ {
+		d *= 2
+	}
+	if d > retries.max {
+		d = retries.max
+	}
+	return d
+}
+
+// getNew fetches the mentions since the latest ID or timestamp, page by
+// page until an empty page is returned. With more than one worker, the
+// pages are fetched concurrently, but returned in order all the same. With
+// a checkpoint, the pages already fetched by an earlier attempt at the same
+// query are not fetched again.
+func getNew(ctx context.Context, uri string, latest interface{}, o fetchOptions) (mm []mention.Mention, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return
+	}
+
+	q := u.Query()
+	switch l := latest.(type) {
+	case int:
+		q.Set("since_id", strconv.Itoa(l))
+	case time.Time:
+		q.Set("since", l.Format(time.RFC3339))
+	}
+	u.RawQuery = q.Encode()
+
+	var next, want, inFlight int
+	var cp *checkpoint
+	seen := map[int]bool{}
+	if o.checkpoint != "" {
+		if cp, mm, err = openCheckpoint(o.checkpoint, redact(u.String())); err != nil {
+			return
+		}
+		if cp.pages > 0 {
+			slog.Info("resuming from checkpoint", "page", cp.pages, "count", len(mm))
+		}
+		next, want = cp.pages, cp.pages
+		for _, m := range mm {
+			seen[m.ID()] = true
+		}
+	}
+
+	workers := o.workers
+	if workers < 1 {
+		workers = 1
+	}
+	// abandon the requests for the pages past the end (or a failure)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		page int
+		mm   []mention.Mention
+		err  error
+	}
+	results := make(chan result)
+	pending := map[int]result{}
+	var done bool
+
+	for {
+		for ; !done && inFlight < workers; next++ {
+			inFlight++
+			go func(page int) {
+				pu := *u
+				m, err := getNextPage(ctx, &pu, page, o.timeout)
+				results <- result{page, m, err}
+			}(next)
+		}
+		if inFlight == 0 {
+			return
+		}
+
+		r := <-results
+		inFlight--
+		pending[r.page] = r
+		// the pages past the end (or a failure) are only waited for
+		for r, ok := pending[want]; ok && !done; r, ok = pending[want] {
+			delete(pending, want)
+			want++
+			if r.err != nil {
+				err, done = r.err, true
+				break
+			}
+			if cp != nil && len(r.mm) > 0 {
+				if cerr := cp.add(r.page, r.mm); cerr != nil {
+					slog.Warn("could not save checkpoint", "err", cerr)
+					cp = nil
+				}
+			}
+			summary.Fetched += len(r.mm)
+			done = len(r.mm) == 0
+			for _, m := range r.mm {
+				// the pages shift as new mentions come in
+				if id := m.ID(); id == 0 || !seen[id] {
+					seen[id] = true
+					mm = append(mm, m)
+				}
+			}
+		}
+		if done {
+			cancel()
+		}
+	}
+}
+
+func getNextPage(ctx context.Context, u *url.URL, page int, timeout time.Duration) (mm []mention.Mention, err error) {
+	q := u.Query()
+	q.Set("page", strconv.Itoa(page))
+	u.RawQuery = q.Encode()
+	slog.Debug("fetching page", "url", redact(u.String()))
+	mm, err = getPage(ctx, u.String(), timeout)
+	if err == nil {
+		slog.Debug("fetched page", "page", page, "count", len(mm))
+	}
+	return
+}
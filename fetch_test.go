@@ -0,0 +1,344 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetPageRetry(t *testing.T) {
+	retries.base = time.Millisecond
+	defer func() { retries.base = time.Second }()
+
+	tests := map[string]struct {
+		failures int
+		code     int
+		header   string
+		wantErr  bool
+		wantHits int
+	}{
+		"server error":       {2, http.StatusServiceUnavailable, "", false, 3},
+		"too many requests":  {1, http.StatusTooManyRequests, "0", false, 2},
+		"not found":          {1, http.StatusNotFound, "", true, 1},
+		"persistent failure": {10, http.StatusBadGateway, "", true, retries.attempts + 1},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var hits int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				if hits <= tc.failures {
+					if tc.header != "" {
+						w.Header().Set("Retry-After", tc.header)
+					}
+					http.Error(w, "<html>oops</html>", tc.code)
+					return
+				}
+				fmt.Fprint(w, `{"links":[{"id":1}]}`)
+			}))
+			defer ts.Close()
+
+			mm, err := getPage(context.Background(), ts.URL, 0)
+			if tc.wantErr {
+				var se *statusError
+				if !errors.As(err, &se) || se.code != tc.code {
+					t.Fatalf("want status %d error, got %v", tc.code, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(mm) != 1 {
+					t.Fatalf("want 1 mention, got %d", len(mm))
+				}
+			}
+			if hits != tc.wantHits {
+				t.Fatalf("want %d requests, got %d", tc.wantHits, hits)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	refused := ts.URL
+	ts.Close()
+
+	tests := map[string]struct {
+		url  string
+		want bool
+	}{
+		"connection refused": {refused, true},
+		"unsupported scheme": {"htp://example.org/", false},
+		"invalid port":       {"http://127.0.0.1:99999/", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := http.Get(tc.url)
+			if err == nil {
+				t.Fatal("want error")
+			}
+			if got := isTransient(err); got != tc.want {
+				t.Fatalf("%v: want %v, got %v", err, tc.want, got)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, refused, nil)
+	if _, err := http.DefaultClient.Do(req); !isTransient(err) {
+		t.Fatalf("%v: want timeout to be transient", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := map[string]struct {
+		header string
+		want   time.Duration
+	}{
+		"empty":   {"", 0},
+		"seconds": {"120", 2 * time.Minute},
+		"garbage": {"soon", 0},
+		"past":    {"Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := retryAfter(tc.header); got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		if got := backoff(i); got != w {
+			t.Fatalf("attempt %d: want %s, got %s", i, w, got)
+		}
+	}
+	if got := backoff(100); got != retries.max {
+		t.Fatalf("want backoff capped at %s, got %s", retries.max, got)
+	}
+}
+
+func TestGetPageRedactsToken(t *testing.T) {
+	retries.attempts = 0
+	defer func() { retries.attempts = 5 }()
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	uu := []string{ts.URL + "?token=s3cr3t"}
+	ts.Close()
+	ts = httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	uu = append(uu, ts.URL+"?token=s3cr3t&page=1")
+
+	for _, u := range uu {
+		_, err := getPage(context.Background(), u, 0)
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Fatalf("token not redacted: %s", err)
+		}
+	}
+}
+
+func TestGetNewWorkers(t *testing.T) {
+	retries.attempts = 0
+	defer func() { retries.attempts = 5 }()
+
+	const pages, perPage = 7, 3
+	for _, workers := range []int{0, 1, 3, 20} {
+		for _, failing := range []int{-1, 2} {
+			t.Run(fmt.Sprintf("%d workers, failing page %d", workers, failing), func(t *testing.T) {
+				var mu sync.Mutex
+				var running, maxRunning int
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					running++
+					if running > maxRunning {
+						maxRunning = running
+					}
+					mu.Unlock()
+					defer func() {
+						mu.Lock()
+						running--
+						mu.Unlock()
+					}()
+
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					// the later pages come first
+					time.Sleep(time.Duration(pages-page) * time.Millisecond)
+					if page == failing {
+						http.NotFound(w, r)
+						return
+					}
+					var mm []string
+					for i := 0; page < pages && i < perPage; i++ {
+						mm = append(mm, fmt.Sprintf(`{"id":%d}`, page*perPage+i+1))
+					}
+					fmt.Fprintf(w, `{"links":[%s]}`, strings.Join(mm, ","))
+				}))
+				defer ts.Close()
+
+				mm, err := getNew(context.Background(), ts.URL, 0, fetchOptions{workers: workers})
+				want := pages * perPage
+				if failing >= 0 {
+					if err == nil {
+						t.Fatal("want error, got nil")
+					}
+					want = failing * perPage
+				} else if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(mm) != want {
+					t.Fatalf("want %d mentions, got %d", want, len(mm))
+				}
+				for i, m := range mm {
+					if m.ID() != i+1 {
+						t.Fatalf("want ID %d at %d, got %d", i+1, i, m.ID())
+					}
+				}
+				if limit := workers; maxRunning > limit && maxRunning > 1 {
+					t.Fatalf("want at most %d concurrent requests, got %d", limit, maxRunning)
+				}
+			})
+		}
+	}
+}
+
+func TestGetPageTimeout(t *testing.T) {
+	retries.base = time.Millisecond
+	defer func() { retries.base = time.Second }()
+
+	var hits int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if hits == 1 {
+			// stall the first request
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		fmt.Fprint(w, `{"links":[{"id":1}]}`)
+	}))
+	defer ts.Close()
+
+	mm, err := getPage(context.Background(), ts.URL, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 1 || hits != 2 {
+		t.Fatalf("want 1 mention in 2 requests, got %d in %d", len(mm), hits)
+	}
+}
+
+func TestGetNewNoList(t *testing.T) {
+	for _, body := range []string{`{}`, `{"error":"invalid token"}`} {
+		t.Run(body, func(t *testing.T) {
+			var hits int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits++
+				fmt.Fprint(w, body)
+			}))
+			defer ts.Close()
+
+			if _, err := getNew(context.Background(), ts.URL, nil, fetchOptions{workers: 1}); err == nil {
+				t.Fatal("want error for a response without webmentions list")
+			}
+			if hits != 1 {
+				t.Fatalf("want 1 request, got %d", hits)
+			}
+		})
+	}
+}
+
+func TestGetNewCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "0" {
+			fmt.Fprint(w, `{"links":[{"id":1}]}`)
+			return
+		}
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	start := time.Now()
+	_, err := getNew(ctx, ts.URL, 0, fetchOptions{workers: 2})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("cancellation took %s", d)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	var l limiter
+	l.setRate(50)
+
+	var mu sync.Mutex
+	var starts []time.Time
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				if err := l.wait(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				starts = append(starts, time.Now())
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	if d, want := starts[len(starts)-1].Sub(starts[0]), 11*20*time.Millisecond; d < want {
+		t.Fatalf("want %d requests to take at least %s, took %s", len(starts), want, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.setRate(0.1)
+	_ = l.wait(ctx)
+	cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
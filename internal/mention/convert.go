@@ -0,0 +1,186 @@
+package mention
+
+import (
+	"strings"
+	"time"
+)
+
+// contentPrefix marks the keys of the classic data that hold the JF2
+// content other than HTML, i.e. "content_text".
+const contentPrefix = "content_"
+
+// IsJF2 tells whether the mention is in JF2 format.
+func (m Mention) IsJF2() bool {
+	_, id := m["wm-id"]
+	_, src := m["wm-source"]
+	return id || src || m["type"] == "entry"
+}
+
+func (m Mention) isClassic() bool {
+	_, id := m["id"]
+	_, src := m["source"]
+	return id || src
+}
+
+// ToJF2 returns the mention in the JF2 format. Fields that have no JF2
+// counterpart and are not derived from the rest of the mention are kept
+// as they are.
+func (m Mention) ToJF2() Mention {
+	if m.IsJF2() || !m.isClassic() {
+		return m
+	}
+
+	j := Mention{"type": "entry"}
+	for k, v := range m {
+		switch k {
+		case "source", "target", "id", "verified_date", "private", "data", "activity", "verified":
+		default:
+			j[k] = v
+		}
+	}
+
+	copyKey(m, "source", j, "wm-source")
+	copyKey(m, "target", j, "wm-target")
+	copyKey(m, "id", j, "wm-id")
+	copyKey(m, "verified_date", j, "wm-received")
+	copyKey(m, "private", j, "wm-private")
+
+	prop := m.Property()
+	if prop != "" {
+		j["wm-property"] = prop
+		if t, ok := m["target"]; ok && prop != "rsvp" {
+			j[prop] = t
+		}
+	}
+
+	d, _ := m["data"].(map[string]interface{})
+	if a, ok := d["author"].(map[string]interface{}); ok {
+		au := map[string]interface{}{"type": "card"}
+		for k, v := range a {
+			au[k] = v
+		}
+		j["author"] = au
+	}
+	copyKey(d, "url", j, "url")
+	copyKey(d, "published", j, "published")
+	copyKey(d, "name", j, "name")
+
+	content := map[string]interface{}{}
+	rest := map[string]interface{}{}
+	for k, v := range d {
+		switch {
+		case k == "author", k == "url", k == "published", k == "published_ts", k == "name":
+		case k == "content":
+			if c, ok := v.(string); ok {
+				content["html"] = c
+			}
+		case strings.HasPrefix(k, contentPrefix):
+			if v != nil {
+				content[strings.TrimPrefix(k, contentPrefix)] = v
+			}
+		default:
+			rest[k] = v
+		}
+	}
+	if len(content) > 0 {
+		j["content"] = content
+	}
+	if len(rest) > 0 {
+		j["data"] = rest
+	}
+
+	return j
+}
+
+// ToClassic returns the mention in the classic webmention.io format.
+// Fields that have no classic counterpart and are not derived from the
+// rest of the mention are kept as they are.
+func (m Mention) ToClassic() Mention {
+	if !m.IsJF2() {
+		return m
+	}
+
+	prop := m.Property()
+	c := Mention{"verified": true}
+	for k, v := range m {
+		switch k {
+		case "type", "author", "url", "published", "name", "content", "wm-property", "data":
+		case "wm-source", "wm-target", "wm-id", "wm-received", "wm-private":
+		case prop:
+			// the target, except for the RSVP value
+			if prop == "rsvp" {
+				c[k] = v
+			}
+		default:
+			c[k] = v
+		}
+	}
+
+	copyKey(m, "wm-source", c, "source")
+	copyKey(m, "wm-target", c, "target")
+	copyKey(m, "wm-id", c, "id")
+	copyKey(m, "wm-received", c, "verified_date")
+	copyKey(m, "wm-private", c, "private")
+
+	d := map[string]interface{}{}
+	if rest, ok := m["data"].(map[string]interface{}); ok {
+		for k, v := range rest {
+			d[k] = v
+		}
+	}
+	d["url"] = m["url"]
+	d["name"] = m["name"]
+	d["content"] = nil
+	d["published"] = m["published"]
+	d["published_ts"] = nil
+	if a, ok := m["author"].(map[string]interface{}); ok {
+		au := map[string]interface{}{}
+		for k, v := range a {
+			// the classic authors are all cards
+			if k != "type" || v != "card" {
+				au[k] = v
+			}
+		}
+		d["author"] = au
+	}
+	switch co := m["content"].(type) {
+	case map[string]interface{}:
+		for k, v := range co {
+			if k == "html" {
+				d["content"] = v
+			} else {
+				d[contentPrefix+k] = v
+			}
+		}
+	case string:
+		d["content"] = co
+	}
+	if p, ok := m["published"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, p); err == nil {
+			d["published_ts"] = float64(t.Unix())
+		}
+	}
+	c["data"] = d
+
+	if t := activityType(prop); t != "" {
+		c["activity"] = map[string]interface{}{"type": t}
+	}
+
+	return c
+}
+
+func activityType(prop string) string {
+	for k, v := range properties {
+		if v == prop {
+			return k
+		}
+	}
+	return prop
+}
+
+// copyKey copies the value, if any, from one map to another under a new key.
+func copyKey(from map[string]interface{}, fk string, to map[string]interface{}, tk string) {
+	if v, ok := from[fk]; ok && v != nil {
+		to[tk] = v
+	}
+}
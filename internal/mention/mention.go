@@ -0,0 +1,130 @@
+// Package mention provides the webmention model that works with both the
+// classic webmention.io API format and the JF2 one.
+package mention
+
+import (
+	"fmt"
+	"time"
+)
+
+// Mention is a single webmention as returned by the API. All the fields
+// are kept as they are, so that the mention can be saved back unchanged.
+type Mention map[string]interface{}
+
+// Author is the author of a webmention.
+type Author struct {
+	Name  string
+	URL   string
+	Photo string
+}
+
+// classic activity types and the corresponding JF2 properties
+var properties = map[string]string{
+	"like":     "like-of",
+	"reply":    "in-reply-to",
+	"repost":   "repost-of",
+	"bookmark": "bookmark-of",
+	"link":     "mention-of",
+	"rsvp":     "rsvp",
+}
+
+// FromList converts the decoded JSON values to mentions.
+func FromList(vv []interface{}) ([]Mention, error) {
+	mm := make([]Mention, 0, len(vv))
+	for _, v := range vv {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("not a webmention: %v", v)
+		}
+		mm = append(mm, m)
+	}
+	return mm, nil
+}
+
+// ID returns the webmention.io ID of the mention, or 0 if there is none.
+func (m Mention) ID() int {
+	if id, ok := m.either("id", "wm-id").(float64); ok {
+		return int(id)
+	}
+	return 0
+}
+
+// Source returns the URL of the page that mentions the target.
+func (m Mention) Source() string {
+	s, _ := m.either("source", "wm-source").(string)
+	return s
+}
+
+// Target returns the URL of the page mentioned.
+func (m Mention) Target() string {
+	s, _ := m.either("target", "wm-target").(string)
+	return s
+}
+
+// Property returns the kind of the mention as a JF2 property name
+// (like-of, in-reply-to, etc.), regardless of the format of the mention.
+func (m Mention) Property() string {
+	if p, ok := m["wm-property"].(string); ok {
+		return p
+	}
+	a, _ := m["activity"].(map[string]interface{})
+	t, _ := a["type"].(string)
+	if p, ok := properties[t]; ok {
+		return p
+	}
+	return t
+}
+
+// Received returns the time webmention.io received (verified) the mention.
+func (m Mention) Received() time.Time {
+	s, _ := m.either("verified_date", "wm-received").(string)
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Author returns the author of the mention.
+func (m Mention) Author() Author {
+	a, ok := m["author"].(map[string]interface{})
+	if !ok {
+		d, _ := m["data"].(map[string]interface{})
+		a, _ = d["author"].(map[string]interface{})
+	}
+	var au Author
+	au.Name, _ = a["name"].(string)
+	au.URL, _ = a["url"].(string)
+	au.Photo, _ = a["photo"].(string)
+	return au
+}
+
+// Content returns the content of the mention, HTML if available.
+func (m Mention) Content() string {
+	switch c := m["content"].(type) {
+	case map[string]interface{}:
+		if s, ok := c["html"].(string); ok {
+			return s
+		}
+		s, _ := c["text"].(string)
+		return s
+	case string:
+		return c
+	}
+	d, _ := m["data"].(map[string]interface{})
+	if s, ok := d["content"].(string); ok {
+		return s
+	}
+	s, _ := d[contentPrefix+"text"].(string)
+	return s
+}
+
+// either returns the first value it finds while iterating kk for key
+func (m Mention) either(kk ...string) interface{} {
+	for _, k := range kk {
+		if v, ok := m[k]; ok {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package mention_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+const (
+	classic = `{"source":"https://micro.blog/manton/9564124","verified":true,"verified_date":"2020-04-28T15:53:45+00:00","id":788164,"private":false,"data":{"author":{"name":"manton","url":"https://micro.blog/manton","photo":"https://webmention.io/avatar/manton.jpg"},"url":"https://micro.blog/manton/9564124","name":null,"content":"<p>Thanks!</p>","published":"2020-04-28T15:43:28+00:00","published_ts":1588088608},"activity":{"type":"reply","sentence":"manton commented","sentence_html":"manton commented"},"target":"https://evgenykuznetsov.org/posts/2020/microblog-is-bad/"}`
+	jf2     = `{"type":"entry","author":{"type":"card","name":"manton","photo":"https://webmention.io/avatar/manton.jpg","url":"https://micro.blog/manton"},"url":"https://micro.blog/manton/9564124","published":"2020-04-28T15:43:28+00:00","wm-received":"2020-04-28T15:53:45Z","wm-id":788164,"wm-source":"https://micro.blog/manton/9564124","wm-target":"https://evgenykuznetsov.org/posts/2020/microblog-is-bad/","content":{"html":"<p>Thanks!</p>","text":"Thanks!"},"in-reply-to":"https://evgenykuznetsov.org/posts/2020/microblog-is-bad/","wm-property":"in-reply-to","wm-private":false}`
+)
+
+func TestAccessors(t *testing.T) {
+	for name, data := range map[string]string{"classic": classic, "jf2": jf2} {
+		t.Run(name, func(t *testing.T) {
+			var m mention.Mention
+			if err := json.Unmarshal([]byte(data), &m); err != nil {
+				t.Fatal(err)
+			}
+
+			assertEqual(t, 788164, m.ID())
+			assertEqual(t, "https://micro.blog/manton/9564124", m.Source())
+			assertEqual(t, "https://evgenykuznetsov.org/posts/2020/microblog-is-bad/", m.Target())
+			assertEqual(t, "in-reply-to", m.Property())
+			assertEqual(t, "<p>Thanks!</p>", m.Content())
+			assertEqual(t, mention.Author{
+				Name:  "manton",
+				URL:   "https://micro.blog/manton",
+				Photo: "https://webmention.io/avatar/manton.jpg",
+			}, m.Author())
+			if want := time.Date(2020, 4, 28, 15, 53, 45, 0, time.UTC); !m.Received().Equal(want) {
+				t.Errorf("\nwant: %s,\n got: %s", want, m.Received())
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	var m mention.Mention
+	if err := json.Unmarshal([]byte(classic), &m); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got interface{}
+	_ = json.Unmarshal([]byte(classic), &want)
+	_ = json.Unmarshal(b, &got)
+	wb, _ := json.Marshal(want)
+	gb, _ := json.Marshal(got)
+	assertEqual(t, string(wb), string(gb))
+}
+
+func TestFromList(t *testing.T) {
+	if _, err := mention.FromList([]interface{}{map[string]interface{}{}, "bogus"}); err == nil {
+		t.Errorf("want error for a non-object")
+	}
+}
+
+func assertEqual(t *testing.T, want, got interface{}) {
+	t.Helper()
+	if want != got {
+		t.Errorf("\nwant: %v,\n got: %v", want, got)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	var c, j mention.Mention
+	if err := json.Unmarshal([]byte(classic), &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(jf2), &j); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		in      mention.Mention
+		convert func(mention.Mention) mention.Mention
+		wantJF2 bool
+	}{
+		"classic to JF2":    {c, mention.Mention.ToJF2, true},
+		"JF2 to classic":    {j, mention.Mention.ToClassic, false},
+		"JF2 to JF2":        {j, mention.Mention.ToJF2, true},
+		"classic roundtrip": {c.ToJF2(), mention.Mention.ToClassic, false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := tc.convert(tc.in)
+			assertEqual(t, tc.wantJF2, got.IsJF2())
+			assertEqual(t, tc.in.ID(), got.ID())
+			assertEqual(t, tc.in.Source(), got.Source())
+			assertEqual(t, tc.in.Target(), got.Target())
+			assertEqual(t, tc.in.Property(), got.Property())
+			assertEqual(t, tc.in.Content(), got.Content())
+			assertEqual(t, tc.in.Author(), got.Author())
+			if !got.Received().Equal(tc.in.Received()) {
+				t.Errorf("\nwant: %s,\n got: %s", tc.in.Received(), got.Received())
+			}
+		})
+	}
+}
+
+func TestConvertKeepsUnknown(t *testing.T) {
+	m := mention.Mention{"id": float64(1), "source": "a", "extra": "kept"}
+	j := m.ToJF2()
+	assertEqual(t, "kept", j["extra"])
+	assertEqual(t, "kept", j.ToClassic()["extra"])
+
+	ts := mention.Mention{"timestamp": "2021-06-07T22:21:17Z"}
+	assertEqual(t, 1, len(ts.ToJF2()))
+	assertEqual(t, 1, len(ts.ToClassic()))
+}
+
+func TestConvertLossless(t *testing.T) {
+	const rsvp = `{"type":"entry","author":{"type":"card","name":"Alice","url":"https://a.example/","photo":"https://a.example/me.jpg"},"url":"https://a.example/rsvp/","published":"2021-06-07T20:00:00+00:00","wm-received":"2021-06-07T22:21:17Z","wm-id":42,"wm-source":"https://a.example/rsvp/","wm-target":"https://example.org/event/","content":{"html":"<p>I'll be there!</p>","text":"I'll be there!","value":"I'll be there!"},"rsvp":"yes","wm-property":"rsvp","wm-private":false}`
+	var m mention.Mention
+	if err := json.Unmarshal([]byte(rsvp), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	c := m.ToClassic()
+	assertEqual(t, "yes", c["rsvp"])
+	assertEqual(t, "<p>I'll be there!</p>", c.Content())
+	if got := c.ToJF2(); !reflect.DeepEqual(got, m) {
+		t.Errorf("\nwant: %v,\n got: %v", m, got)
+	}
+
+	// the classic data with no JF2 counterpart is kept, nulls are skipped
+	var cm mention.Mention
+	if err := json.Unmarshal([]byte(classic), &cm); err != nil {
+		t.Fatal(err)
+	}
+	cm["data"].(map[string]interface{})["swarm_coins"] = 5.0
+	j := cm.ToJF2()
+	if _, ok := j["name"]; ok {
+		t.Errorf("want no name, got %v", j["name"])
+	}
+	if got := j.ToClassic()["data"].(map[string]interface{}); !reflect.DeepEqual(got, cm["data"]) {
+		t.Errorf("\nwant: %v,\n got: %v", cm["data"], got)
+	}
+}
@@ -0,0 +1,111 @@
+// Package safefile writes files so that a crash or a full disk never
+// leaves them half-written, optionally keeping rotated previous copies.
+package safefile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Write atomically replaces the contents of the file with data. If backups
+// is positive, up to that many previous versions of the file are kept as
+// fn.1 (the most recent), fn.2 and so on.
+func Write(fn string, data []byte, backups int) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(fn); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := Rotate(fn, backups); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Append adds data to the end of the file, creating the file if necessary.
+// Appending is not atomic, but if it fails the file is truncated back to
+// its original size. Backups are rotated the same way Write does.
+func Append(fn string, data []byte, backups int) error {
+	if err := Rotate(fn, backups); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if terr := f.Truncate(fi.Size()); terr != nil {
+			err = fmt.Errorf("%w (and failed to roll back: %v)", err, terr)
+		}
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Rotate shifts the existing backups of the file by one, dropping the
+// oldest, and copies the file itself to fn.1. It does nothing if backups
+// is not positive or the file does not exist.
+func Rotate(fn string, backups int) error {
+	if backups < 1 {
+		return nil
+	}
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		from := backupName(fn, i)
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(from, backupName(fn, i+1)); err != nil {
+			return err
+		}
+	}
+	return copyFile(fn, backupName(fn, 1))
+}
+
+func backupName(fn string, i int) string {
+	return fmt.Sprintf("%s.%d", fn, i)
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return Write(to, data, 0)
+}
@@ -0,0 +1,87 @@
+package safefile_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+
+	for _, v := range []string{"one", "two", "three", "four"} {
+		if err := safefile.Write(fn, []byte(v), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		"webmentions.json":   "four",
+		"webmentions.json.1": "three",
+		"webmentions.json.2": "two",
+	}
+	assertDir(t, dir, want)
+}
+
+func TestAppend(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.jsonl")
+
+	for _, v := range []string{"one\n", "two\n"} {
+		if err := safefile.Append(fn, []byte(v), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		"webmentions.jsonl":   "one\ntwo\n",
+		"webmentions.jsonl.1": "one\n",
+	}
+	assertDir(t, dir, want)
+}
+
+func TestWriteReadOnly(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+	if err := safefile.Write(fn, []byte("old"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0777)
+
+	if err := safefile.Write(fn, []byte("new"), 0); err == nil {
+		t.Fatal("want error writing to read-only directory")
+	}
+	assertDir(t, dir, map[string]string{"webmentions.json": "old"})
+}
+
+func assertDir(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+
+	ff, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ff) != len(want) {
+		t.Fatalf("want %d files, got %d", len(want), len(ff))
+	}
+	for name, content := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Fatalf("%s: want %q, got %q", name, content, got)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	tests := map[string]struct {
+		format  string
+		level   slog.Level
+		want    []string
+		wantErr bool
+	}{
+		"text":    {"text", logLevel(false, false), []string{"level=INFO", "level=WARN"}, false},
+		"quiet":   {"text", logLevel(true, false), []string{"level=WARN"}, false},
+		"verbose": {"", logLevel(false, true), []string{"level=DEBUG", "level=INFO", "level=WARN"}, false},
+		"json":    {"json", logLevel(false, false), []string{`"level":"INFO"`, `"level":"WARN"`}, false},
+		"unknown": {"xml", logLevel(false, false), nil, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var bb bytes.Buffer
+			l, err := newLogger(&bb, tc.format, tc.level)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Debug("debug")
+			l.Info("info")
+			l.Warn("warn")
+
+			lines := strings.Split(strings.TrimSpace(bb.String()), "\n")
+			if len(lines) != len(tc.want) {
+				t.Fatalf("want %d lines, got %q", len(tc.want), lines)
+			}
+			for i, w := range tc.want {
+				if !strings.Contains(lines[i], w) {
+					t.Fatalf("want %s in %q", w, lines[i])
+				}
+				if tc.format == "json" && !json.Valid([]byte(lines[i])) {
+					t.Fatalf("not JSON: %q", lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerboseRequests(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "0" {
+			fmt.Fprint(w, `{"links":[{"id":1},{"id":2}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	var bb bytes.Buffer
+	l, _ := newLogger(&bb, "text", logLevel(false, true))
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(l)
+
+	if _, err := getNew(context.Background(), ts.URL+"?token=s3cr3t", 0, fetchOptions{workers: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := bb.String()
+	if strings.Contains(out, "s3cr3t") {
+		t.Fatalf("token not redacted: %s", out)
+	}
+	for _, w := range []string{"page=0 count=2", "page=1 count=0", "token=REDACTED"} {
+		if !strings.Contains(out, w) {
+			t.Fatalf("want %s logged, got %s", w, out)
+		}
+	}
+}
+
+func TestLogToStderr(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+	mm := mustParse(t, `[{"id":1,"source":"https://src.example/"},{"id":1,"source":"https://src.example/"}]`)
+	if err := writeFile(mm, cfg{filename: fn}); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	}()
+	var err error
+	if os.Stdout, err = os.Create(filepath.Join(dir, "stdout")); err != nil {
+		t.Fatal(err)
+	}
+	if os.Stderr, err = os.Create(filepath.Join(dir, "stderr")); err != nil {
+		t.Fatal(err)
+	}
+	err = run(context.Background(), []string{"dedupe", "-log", "json", "-f", fn})
+	os.Stdout.Close()
+	os.Stderr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := ioutil.ReadFile(filepath.Join(dir, "stdout"))
+	if !strings.Contains(string(out), "Removed 1 duplicate webmentions.") || strings.Contains(string(out), `"level"`) {
+		t.Fatalf("want the report only on stdout, got %s", out)
+	}
+	log, _ := ioutil.ReadFile(filepath.Join(dir, "stderr"))
+	for _, l := range strings.Split(strings.TrimSpace(string(log)), "\n") {
+		if !json.Valid([]byte(l)) {
+			t.Fatalf("want JSON log lines, got %q", l)
+		}
+	}
+}
@@ -18,124 +18,168 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"log/slog"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
 	ipath "evgenykuznetsov.org/go/webmention.io-backup/internal/path"
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
 )
 
-const endpoint = "https://webmention.io/api/mentions"
+const (
+	endpoint = "https://webmention.io/api/mentions"
+	apiPath  = "/api/mentions"
+	tokenEnv = "WEBMENTION_IO_TOKEN"
+)
 
 type cfg struct {
 	filename   string
+	database   string
+	api        string
 	token      string
+	tokenFile  string
 	domain     string
+	target     string
+	workers    int
+	perPage    int
+	rate       float64
+	split      bool
 	useJF2     bool
 	tlo        bool
 	pretty     bool
+	jsonl      bool
 	contentDir string
 	squashLeft []string
 	languages  bool
 	timestamp  bool
+	backups    int
+	apply      bool
+	dryRun     bool
+	planFile   string
+	duplicates string
+	// plan collects what a dry run would save
+	plan *plan
+	// requestTimeout is for each request
+	requestTimeout time.Duration
 }
 
 var version string = "custom"
 
 func main() {
-	fmt.Printf("webmention.io-backup version %s\n", version)
-
-	config := cfg{}
-	var sl string
-	flag.StringVar(&config.filename, "f", "webmentions.json", "filename")
-	flag.StringVar(&config.token, "t", "", "API token")
-	flag.StringVar(&config.domain, "d", "", "domain to fetch webmentions for")
-	flag.BoolVar(&config.useJF2, "jf2", false, "use JF2 endpoint instead of the classic one")
-	flag.BoolVar(&config.tlo, "tlo", true, "wrap output in a top-level object (links list or feed)")
-	flag.BoolVar(&config.pretty, "p", false, "pretty-print the output (jq-style)")
-	flag.StringVar(&config.contentDir, "cd", "", "directory to look for structure in; if specified, attempts are made to save according to paths")
-	flag.StringVar(&sl, "l", "", "list of top-level subdirs to drop while saving according to paths, comma-separated")
-	flag.BoolVar(&config.languages, "lang", false, "insert language into the filename before extension (for Hugo page bundles)")
-	flag.BoolVar(&config.timestamp, "ts", false, "save timestamp to root dir file and only fetch newer mentions")
-	flag.Parse()
-	config.squashLeft = strings.Split(sl, ",")
-	url := endpointUrl(config)
-
-	mm, err := readFile(filepath.Join(config.contentDir, config.filename))
-	if err != nil && config.contentDir == "" {
-		fmt.Println(err)
-	} else {
-		fmt.Printf("Found %d existing webmentions, will fetch newer IDs.\n", len(mm))
-	}
-
-	var m []interface{}
-	if !config.timestamp {
-		m, err = getNew(url, findLast(mm))
-	} else {
-		fmt.Println("Will check for timestamp.")
-		m, err = getNew(url, getTimestamp(mm))
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// let a second signal kill the program
+		stop()
+	}()
+
+	err := run(ctx, os.Args[1:])
+	stop()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		slog.Error(err.Error())
 	}
+	os.Exit(exitStatus(err))
+}
 
-	if len(m) == 0 {
-		fmt.Println("No new webmentions found.")
-	} else {
-		if config.contentDir != "" {
-			if err := saveToDirs(m, config); err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-		} else {
-			fmt.Printf("Appending %d new webmentions.\n", len(m))
-			mm = append(mm, m...)
-			err = writeFile(mm, config)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Printf("Saved %d webmentions to %s.\n", len(mm), config.filename)
-			}
-		}
+func readFile(fn string) (mm []mention.Mention, err error) {
+	mm, _, err = readArchive(fn)
+	return
+}
+
+// archiveFormat is how the mentions are written in an archive file.
+type archiveFormat struct {
+	// lines is set for JSON Lines, one mention per line
+	lines bool
+	// cut is set if the last line was cut short, so the file is to be
+	// rewritten rather than appended to
+	cut bool
+	// tlo is set if the list is wrapped in a top-level object, jf2 if it
+	// is a JF2 feed rather than the classic links list
+	tlo, jf2 bool
+}
+
+// appendable tells whether the new mentions can be appended to the file.
+func (f archiveFormat) appendable() bool {
+	return f.lines && !f.cut
+}
+
+// rewrite returns the configuration to rewrite the file with, keeping its
+// format unless it is to become JSON Lines.
+func (f archiveFormat) rewrite(c cfg) cfg {
+	if c.jsonl || f.lines {
+		c.jsonl = true
+		return c
 	}
+	c.tlo, c.useJF2 = f.tlo, f.jf2
+	return c
+}
 
-	fmt.Println("All done!")
+// formatOf returns the format of the files written with the configuration.
+func formatOf(c cfg) archiveFormat {
+	return archiveFormat{lines: c.jsonl, tlo: c.tlo, jf2: c.useJF2}
 }
 
-func readFile(fn string) (mm []interface{}, err error) {
+// readArchive reads the mentions from the file, and also tells its format,
+// i.e. whether it is in JSON Lines format and can be appended to.
+func readArchive(fn string) (mm []mention.Mention, f archiveFormat, err error) {
 	data, err := ioutil.ReadFile(fn)
 	if err != nil {
 		return
 	}
-	mm, err = parsePage(data)
+	mm, f, err = parseArchive(data)
+	if err != nil {
+		if mm, ok := dropPartialLine(data); ok {
+			// the file is rewritten on the next save, not appended to
+			slog.Warn("dropped the partial last line, the file was not saved completely", "file", fn)
+			return mm, archiveFormat{lines: true, cut: true}, nil
+		}
+		return nil, archiveFormat{}, fmt.Errorf("%s: %w", fn, err)
+	}
 	return
 }
 
-func findLast(mm []interface{}) (latest int) {
-	for _, f := range mm {
-		m, _ := f.(map[string]interface{})
-		id := either(m, []string{"id", "wm-id"})
-		if l, ok := id.(float64); ok {
-			this := int(l)
-			if this > latest {
-				latest = this
-			}
+// dropPartialLine parses a JSON Lines file whose last line was cut short
+// (i.e. by a crash while appending to it), without that line.
+func dropPartialLine(data []byte) ([]mention.Mention, bool) {
+	i := bytes.LastIndexByte(data, '\n')
+	if i < 0 || i == len(data)-1 || !isLines(data[:i+1]) {
+		return nil, false
+	}
+	mm, _, err := parseArchive(data[:i+1])
+	return mm, err == nil
+}
+
+func findLast(mm []mention.Mention) (latest int) {
+	for _, m := range mm {
+		if id := m.ID(); id > latest {
+			latest = id
 		}
 	}
 	return
 }
 
-func writeFile(mm []interface{}, c cfg) error {
+func writeFile(mm []mention.Mention, c cfg) error {
+	if mm == nil {
+		// an empty list, not null
+		mm = []mention.Mention{}
+	}
+	if c.jsonl {
+		return writeLines(mm, c, false)
+	}
+
 	var bb bytes.Buffer
 	var f interface{}
 	if !c.tlo {
@@ -143,13 +187,13 @@ func writeFile(mm []interface{}, c cfg) error {
 	} else {
 		if c.useJF2 {
 			f = struct {
-				Type     string        `json:"type"`
-				Name     string        `json:"name"`
-				Children []interface{} `json:"children"`
+				Type     string            `json:"type"`
+				Name     string            `json:"name"`
+				Children []mention.Mention `json:"children"`
 			}{"feed", "Webmentions", mm}
 		} else {
 			f = struct {
-				Links []interface{} `json:"links"`
+				Links []mention.Mention `json:"links"`
 			}{mm}
 		}
 	}
@@ -162,54 +206,73 @@ func writeFile(mm []interface{}, c cfg) error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(c.filename, bb.Bytes(), 0644)
-	return err
+	if err := safefile.Write(c.filename, bb.Bytes(), c.backups); err != nil {
+		return err
+	}
+	summary.wrote(c.filename)
+	return nil
 }
 
-func saveToDirs(mm []interface{}, c cfg) (err error) {
-	var ts time.Time
-	if c.timestamp {
-		fn := filepath.Join(c.contentDir, c.filename)
-		mm, _ := readFile(fn)
-		ts = getTimestamp(mm)
-	}
+// writeLines writes the mentions to the file in JSON Lines format, either
+// replacing the file or appending to it.
+func writeLines(mm []mention.Mention, c cfg, appendLines bool) error {
+	var bb bytes.Buffer
+	enc := json.NewEncoder(&bb)
+	enc.SetEscapeHTML(false)
 	for _, m := range mm {
-		t := timeOf(m)
-		if t.After(ts) {
-			ts = t
-		}
-		if !saveToDir(m, c) {
-			if err = saveToContentDir(m, c); err != nil {
-				return
-			}
+		if err := enc.Encode(m); err != nil {
+			return err
 		}
 	}
-	if c.timestamp {
-		err = writeTimestamp(ts, c)
+
+	write := safefile.Write
+	if appendLines {
+		write = safefile.Append
 	}
-	return
+	if err := write(c.filename, bb.Bytes(), c.backups); err != nil {
+		return err
+	}
+	summary.wrote(c.filename)
+	return nil
 }
 
-func saveToDir(m interface{}, c cfg) bool {
-	mn, _ := m.(map[string]interface{})
-	t := either(mn, []string{"target", "wm-target"})
-	tgt, ok := t.(string)
-	if !ok {
+// addToFile saves the new mentions along with the existing ones. If the
+// file is already in JSON Lines format, only the new lines are written.
+func addToFile(existing, mm []mention.Mention, f archiveFormat, c cfg) error {
+	if c.jsonl && f.appendable() {
+		return writeLines(mm, c, true)
+	}
+	return writeFile(append(existing, mm...), c)
+}
+
+func saveToDir(m mention.Mention, c cfg) bool {
+	fn := pageFile(m, c)
+	if fn == "" {
 		return false
 	}
+	c.filename = fn
+	return saveToFile(m, c) == nil
+}
+
+// pageFile returns the file to save the mention to according to its
+// target's path in the content directory, or "" if there is none.
+func pageFile(m mention.Mention, c cfg) string {
+	tgt := m.Target()
+	if tgt == "" {
+		return ""
+	}
 
 	dir := ipath.DirFromUrl(tgt, c.squashLeft)
 	if c.languages {
 		c.filename = ipath.FilenameFromUrl(tgt, c.squashLeft, c.filename)
 	}
-
-	c.contentDir = filepath.Join(c.contentDir, dir)
-
-	err := saveToContentDir(m, c)
-	return err == nil
+	if c.filename == "" {
+		return ""
+	}
+	return filepath.Join(c.contentDir, dir, c.filename)
 }
 
-func saveToContentDir(m interface{}, c cfg) error {
+func saveToContentDir(m mention.Mention, c cfg) error {
 	if c.filename == "" {
 		return fmt.Errorf("no filename specified")
 	}
@@ -217,87 +280,58 @@ func saveToContentDir(m interface{}, c cfg) error {
 	return saveToFile(m, c)
 }
 
-func saveToFile(m interface{}, c cfg) (err error) {
-	mm, _ := readFile(c.filename)
-	for _, exm := range mm {
-		if sameMention(exm, m) {
-			return
-		}
+func saveToFile(m mention.Mention, c cfg) (err error) {
+	mm, f, err := readArchive(c.filename)
+	if err = missingOK(err); err != nil {
+		return
 	}
-	mm = append(mm, m)
-	fmt.Printf("Saving new mention to %s...", c.filename)
-	err = writeFile(mm, c)
-	if err == nil {
-		fmt.Println(" Saved!")
-	} else {
-		fmt.Println()
+	all, added, updated := merge(mm, []mention.Mention{m}, c.duplicates)
+	switch {
+	case added > 0:
+		err = addToFile(mm, all[len(mm):], f, c)
+		if err == nil {
+			summary.New++
+			slog.Debug("saved new mention", "file", c.filename, "id", m.ID())
+		}
+	case updated > 0:
+		err = writeFile(all, c)
+		if err == nil {
+			slog.Debug("updated mention", "file", c.filename, "id", m.ID())
+		}
 	}
 	return
 }
 
-func sameMention(ma, mb interface{}) bool {
-	mapa, oka := ma.(map[string]interface{})
-	mapb, okb := mb.(map[string]interface{})
-	if !oka || !okb {
-		return false
-	}
-
-	q := []string{"source", "wm-source"}
-	sa, sb := either(mapa, q), either(mapb, q)
-	oa, oka := sa.(string)
-	ob, okb := sb.(string)
-	if !oka || !okb || oa != ob {
-		return false
-	}
-
-	q = []string{"verified_date", "wm-received"}
-	sa, sb = either(mapa, q), either(mapb, q)
-	oa, oka = sa.(string)
-	ob, okb = sb.(string)
-	ta, err := time.Parse(time.RFC3339, oa)
-	if err != nil {
-		return false
-	}
-	tb, err := time.Parse(time.RFC3339, ob)
-	if err != nil {
-		return false
-	}
-	if !oka || !okb || !ta.Equal(tb) {
-		return false
-	}
-
-	return true
+// parsePage parses an API response or an archive file written as a single
+// JSON value.
+func parsePage(b []byte) (mm []mention.Mention, err error) {
+	mm, _, err = parseWrapped(b)
+	return
 }
 
-func getPage(url string) (mm []interface{}, err error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+// parseWrapped is parsePage that also tells how the list was wrapped.
+func parseWrapped(b []byte) (mm []mention.Mention, f archiveFormat, err error) {
+	var v interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
 		return
 	}
-	mm, err = parsePage(b)
-	return
-}
-
-func parsePage(b []byte) (mm []interface{}, err error) {
-	var f interface{}
-	err = json.Unmarshal(b, &f)
 
 	// can be classic api/mentions with "links" array as a root object
 	// or JF2 feed
 	// or just an array of objects like we write it
-	switch m := f.(type) {
+	switch m := v.(type) {
 	case map[string]interface{}:
-		mentions := either(m, []string{"links", "children"})
-		if mnts, ok := mentions.([]interface{}); ok {
-			mm = mnts
+		mnts, ok := either(m, []string{"links", "children"}).([]interface{})
+		if !ok {
+			return nil, f, fmt.Errorf("no webmentions list in JSON")
 		}
+		_, links := m["links"]
+		f.tlo, f.jf2 = true, !links
+		mm, err = mention.FromList(mnts)
 	case []interface{}:
-		mm = m
+		mm, err = mention.FromList(m)
+	case nil:
+		// an empty array written as null
 	default:
 		err = fmt.Errorf("could not parse JSON")
 	}
@@ -305,60 +339,70 @@ func parsePage(b []byte) (mm []interface{}, err error) {
 	return
 }
 
-func getNew(uri string, latest interface{}) (mm []interface{}, err error) {
-	u, err := url.Parse(uri)
-	if err != nil {
-		return
+// parseArchive parses an archive file, that can also be in JSON Lines
+// format, one mention per line.
+func parseArchive(b []byte) ([]mention.Mention, archiveFormat, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		// JSON Lines file with no lines
+		return nil, archiveFormat{}, nil
+	}
+	if !isLines(b) {
+		return parseWrapped(b)
 	}
 
-	q := u.Query()
-	switch l := latest.(type) {
-	case int:
-		q.Set("since_id", strconv.Itoa(l))
-	case time.Time:
-		q.Set("since", l.Format(time.RFC3339))
+	f := archiveFormat{lines: true}
+	var vv []interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, f, fmt.Errorf("could not parse JSON Lines: %w", err)
+		}
+		vv = append(vv, v)
 	}
-	u.RawQuery = q.Encode()
+	mm, err := mention.FromList(vv)
+	return mm, f, err
+}
 
-	ok := true
+// scanLines calls fn for each of the mentions in a JSON Lines file, one at
+// a time, without reading the whole file in memory. ok is false if the file
+// is not in JSON Lines format or its last line is cut short, then it is to
+// be read with readArchive instead, and the mentions passed to fn so far
+// are to be discarded.
+func scanLines(fn string, each func(m mention.Mention)) (ok bool, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
 
-	for i := 0; ok; i++ {
-		m, err := getNextPage(u, i)
-		if err != nil {
-			return mm, err
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for first := true; dec.More(); first = false {
+		var m map[string]interface{}
+		if err := dec.Decode(&m); err != nil || m == nil {
+			return false, nil
 		}
-		mm = append(mm, m...)
-		if len(m) == 0 {
-			ok = false
+		if first && either(m, []string{"links", "children"}) != nil {
+			return false, nil
 		}
+		each(m)
 	}
-
-	return
-}
-
-func getNextPage(u *url.URL, page int) (mm []interface{}, err error) {
-	q := u.Query()
-	q.Set("page", strconv.Itoa(page))
-	u.RawQuery = q.Encode()
-	mm, err = getPage(u.String())
-	return
+	return true, nil
 }
 
-func timeOf(m interface{}) (t time.Time) {
-	e, _ := m.(map[string]interface{})
-	tm := either(e, []string{"verified_date", "wm-received"})
-	if ts, ok := tm.(string); ok {
-		if te, err := time.Parse(time.RFC3339, ts); err == nil {
-			t = te
-		}
+// isLines tells whether the data is in JSON Lines format, as opposed to
+// a single JSON array or object wrapping the mentions.
+func isLines(b []byte) bool {
+	var f interface{}
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&f); err != nil {
+		return false
 	}
-	return
+	m, ok := f.(map[string]interface{})
+	return ok && either(m, []string{"links", "children"}) == nil
 }
 
-func parseTimestamp(m interface{}) (ts time.Time, ok bool) {
-	e, _ := m.(map[string]interface{})
-	t := e["timestamp"]
-	if tst, yep := t.(string); yep {
+func parseTimestamp(m mention.Mention) (ts time.Time, ok bool) {
+	if tst, yep := m["timestamp"].(string); yep {
 		tm, err := time.Parse(time.RFC3339, tst)
 		if err == nil {
 			ts = tm
@@ -368,7 +412,7 @@ func parseTimestamp(m interface{}) (ts time.Time, ok bool) {
 	return
 }
 
-func getTimestamp(mm []interface{}) (ts time.Time) {
+func getTimestamp(mm []mention.Mention) (ts time.Time) {
 	for _, m := range mm {
 		if tst, ok := parseTimestamp(m); ok && tst.After(ts) {
 			ts = tst
@@ -377,30 +421,20 @@ func getTimestamp(mm []interface{}) (ts time.Time) {
 	return
 }
 
-func setTimestamp(mm []interface{}, ts time.Time) (mmt []interface{}) {
-	for _, m := range mm {
-		if _, ok := parseTimestamp(m); !ok {
-			mmt = append(mmt, m)
-		}
+// apiToken returns the API token given explicitly, read from the token file,
+// or taken from the environment, in that order of preference.
+func apiToken(c cfg) (string, error) {
+	if c.token != "" {
+		return c.token, nil
 	}
-	t := struct {
-		T string `json:"timestamp"`
-	}{ts.Format(time.RFC3339)}
-	mmt = append(mmt, t)
-	return
-}
-
-func writeTimestamp(ts time.Time, c cfg) (err error) {
-	fn := filepath.Join(c.contentDir, c.filename)
-	mm, err := readFile(fn)
-	if err != nil {
-		return
+	if c.tokenFile != "" {
+		b, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
 	}
-
-	mm = setTimestamp(mm, ts)
-	c.filename = fn
-	err = writeFile(mm, c)
-	return
+	return os.Getenv(tokenEnv), nil
 }
 
 func endpointUrl(c cfg) string {
@@ -409,6 +443,9 @@ func endpointUrl(c cfg) string {
 		"token":  c.token,
 		"domain": c.domain,
 	}
+	if c.perPage > 0 {
+		vv["per-page"] = strconv.Itoa(c.perPage)
+	}
 	for k, v := range vv {
 		if v != "" {
 			q.Set(k, v)
@@ -419,13 +456,27 @@ func endpointUrl(c cfg) string {
 	if c.useJF2 {
 		e = ".jf2"
 	}
-	ep := fmt.Sprintf("%s%s", endpoint, e)
+	ep := fmt.Sprintf("%s%s", apiEndpoint(c), e)
 
 	u, _ := url.Parse(ep)
 	u.RawQuery = q.Encode()
 	return u.String()
 }
 
+// apiEndpoint returns the mentions API endpoint to use. The configured API
+// URL can be either the full endpoint or just the base URL of the server.
+func apiEndpoint(c cfg) string {
+	if c.api == "" {
+		return endpoint
+	}
+	u, err := url.Parse(c.api)
+	if err != nil || strings.Trim(u.Path, "/") != "" {
+		return strings.TrimSuffix(c.api, "/")
+	}
+	u.Path = apiPath
+	return u.String()
+}
+
 // either returns the first value it finds while iterating kk for key
 func either(m map[string]interface{}, kk []string) interface{} {
 	for _, k := range kk {
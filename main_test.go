@@ -17,6 +17,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -27,6 +28,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
 )
 
 var (
@@ -63,6 +66,7 @@ func TestReadFile(t *testing.T) {
 		"api/mentions":     {"page.json", "page_processed.json"},
 		"api/mentions.jf2": {"jf2.json", "jf2_processed.json"},
 		"simple list":      {"single_file.json", "single_file_processed.json"},
+		"JSON Lines":       {"lines.jsonl", "single_file_processed.json"},
 	}
 
 	for name, tc := range tt {
@@ -78,6 +82,92 @@ func TestReadFile(t *testing.T) {
 	}
 }
 
+func TestAddToFileLines(t *testing.T) {
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cfg{filename: filepath.Join("testdata", "test_output.jsonl"), jsonl: true}
+	defer os.Remove(c.filename)
+	if err := writeFile(mm[:2], c); err != nil {
+		t.Fatal(err)
+	}
+
+	existing, f, err := readArchive(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.appendable() {
+		t.Fatalf("JSON Lines file not recognized")
+	}
+	if err := addToFile(existing, mm[2:], f, c); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(b, []byte("\n")); n != len(mm) {
+		t.Fatalf("want %d lines, got %d", len(mm), n)
+	}
+	got, err := readFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(mm) {
+		t.Fatalf("want %d mentions, got %d", len(mm), len(got))
+	}
+}
+
+func TestReadSingleLine(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "webmentions.jsonl")
+	if err := ioutil.WriteFile(fn, []byte(`{"id":1,"source":"https://a.example/"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mm, f, err := readArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 1 || !f.lines {
+		t.Fatalf("want 1 mention as JSON Lines, got %d (lines: %v)", len(mm), f.lines)
+	}
+	if _, err := parsePage([]byte(`{"id":1,"source":"https://a.example/"}`)); err == nil {
+		t.Fatal("want error for a response without webmentions list")
+	}
+}
+
+func TestReadPartialLine(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "webmentions.jsonl")
+	data := `{"id":1,"source":"https://a.example/"}
+{"id":2,"source":"https://b.example/"}
+{"id":3,"sou`
+	if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mm, f, err := readArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 2 || f.appendable() {
+		t.Fatalf("want 2 mentions to be rewritten, got %d (format: %+v)", len(mm), f)
+	}
+
+	s := newStore(cfg{filename: fn, jsonl: true})
+	if err := s.Append([]mention.Mention{{"id": 3.0, "source": "https://c.example/"}}); err != nil {
+		t.Fatal(err)
+	}
+	mm, f, err = readArchive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 3 || !f.appendable() {
+		t.Fatalf("want 3 mentions as JSON Lines, got %d (format: %+v)", len(mm), f)
+	}
+}
+
 func TestReadFileErr(t *testing.T) {
 	_, err := readFile("testdata")
 	if err == nil {
@@ -110,14 +200,14 @@ func TestSaveToDirs(t *testing.T) {
 	if err := os.Chmod(cdir, 0555); err != nil {
 		t.Fatal(err)
 	}
-	if err := saveToDirs(mm, c); err == nil {
+	if err := archive(newStore(c), mm); err == nil {
 		t.Fatalf("expected error on read-only directory")
 	}
 	if err := os.Chmod(cdir, 0777); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := saveToDirs(mm, c); err != nil {
+	if err := archive(newStore(c), mm); err != nil {
 		t.Fatal(err)
 	}
 
@@ -134,20 +224,27 @@ func TestSaveToDirs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := saveToDirs(mm, c); err != nil {
+	if err := archive(newStore(c), mm); err != nil {
 		t.Fatal(err)
 	}
 	mm, err = readFile(filepath.Join(c.contentDir, c.filename))
 	if err != nil {
 		t.Fatal(err)
 	}
-	want, _ := time.Parse(time.RFC3339, "2020-05-05T14:54:13+00:00")
-	got := getTimestamp(mm)
-	if !want.Equal(got) {
-		t.Fatalf("wrong timestamp, want %s, got %s", want, got)
+	if ts := getTimestamp(mm); !ts.IsZero() {
+		t.Fatalf("timestamp saved to the root file: %s", ts)
+	}
+	if len(mm) != 17 {
+		t.Fatalf("unexpected number of mentions saved, want 17, got %d", len(mm))
 	}
-	if len(mm) != 18 {
-		t.Fatalf("unexpected number of mentions saved, want 18, got %d", len(mm))
+	st, ok, err := readState(stateFile(c))
+	if err != nil || !ok {
+		t.Fatalf("no state file: %v", err)
+	}
+	// the state covers the mentions saved by both runs
+	want, _ := time.Parse(time.RFC3339, "2021-06-07T22:21:17+00:00")
+	if !want.Equal(st.Timestamp) {
+		t.Fatalf("wrong timestamp, want %s, got %s", want, st.Timestamp)
 	}
 }
 
@@ -161,7 +258,7 @@ func TestSaveToDirsErr(t *testing.T) {
 	}
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			if err := saveToDirs([]interface{}{"empty mention"}, tc.config); err == nil {
+			if err := archive(newStore(tc.config), []mention.Mention{{}}); err == nil {
 				t.Fatalf(tc.fail)
 			}
 		})
@@ -181,13 +278,13 @@ func TestWriteFile(t *testing.T) {
 
 	for name, tc := range tt {
 		t.Run(name, func(t *testing.T) {
-			mm := []interface{}{}
+			mm := []mention.Mention{}
 			writeAndCompare(t, mm, tc.config, filepath.Join("testdata", tc.goldenF))
 		})
 	}
 }
 
-func writeAndCompare(t *testing.T, mm []interface{}, c cfg, fn string) {
+func writeAndCompare(t *testing.T, mm []mention.Mention, c cfg, fn string) {
 	t.Helper()
 	wantF := filepath.Join(fn)
 	c.filename = filepath.Join("testdata", "test_output.json")
@@ -230,7 +327,7 @@ func TestGetNew(t *testing.T) {
 			}))
 			defer ts.Close()
 
-			got, err := getNew(ts.URL, tc.arg)
+			got, err := getNew(context.Background(), ts.URL, tc.arg, fetchOptions{workers: 1})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -267,9 +364,10 @@ func TestEndpointUrl(t *testing.T) {
 		config cfg
 		want   string
 	}{
-		"token":  {cfg{token: "t0K3n"}, "?token=t0K3n"},
-		"jf2":    {cfg{useJF2: true}, ".jf2"},
-		"domain": {cfg{domain: "example.org"}, "?domain=example.org"},
+		"token":    {cfg{token: "t0K3n"}, "?token=t0K3n"},
+		"jf2":      {cfg{useJF2: true}, ".jf2"},
+		"domain":   {cfg{domain: "example.org"}, "?domain=example.org"},
+		"per page": {cfg{perPage: 100}, "?per-page=100"},
 	}
 
 	for name, tc := range tt {
@@ -282,6 +380,60 @@ func TestEndpointUrl(t *testing.T) {
 	}
 }
 
+func TestApiEndpoint(t *testing.T) {
+	tt := map[string]struct {
+		api  string
+		want string
+	}{
+		"default":       {"", endpoint},
+		"base URL":      {"https://wm.example.org", "https://wm.example.org/api/mentions"},
+		"base URL /":    {"http://localhost:8080/", "http://localhost:8080/api/mentions"},
+		"full endpoint": {"https://example.org/wm/api/mentions/", "https://example.org/wm/api/mentions"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got := apiEndpoint(cfg{api: tc.api})
+			if got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s\n", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestApiToken(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(fn, []byte("fr0mF1l3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(tokenEnv, "fr0mEnv")
+
+	tt := map[string]struct {
+		config cfg
+		want   string
+	}{
+		"flag": {cfg{token: "t0K3n", tokenFile: fn}, "t0K3n"},
+		"file": {cfg{tokenFile: fn}, "fr0mF1l3"},
+		"env":  {cfg{}, "fr0mEnv"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got, err := apiToken(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := apiToken(cfg{tokenFile: "nosuchfile"}); err == nil {
+		t.Fatal("want error for non-existent token file")
+	}
+}
+
 func TestGetTimestamp(t *testing.T) {
 	bb := []byte(`[{"timestamp":"2021-06-07T22:21:17Z"}]`)
 	mm, err := parsePage(bb)
@@ -0,0 +1,175 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
+)
+
+// plan is what a dry run would have saved.
+type plan struct {
+	Mentions []plannedMention `json:"mentions"`
+	Files    []*plannedFile   `json:"files"`
+	files    map[string]*plannedFile
+}
+
+type plannedMention struct {
+	ID     int    `json:"id"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// plannedFile is a file that would be created or modified.
+type plannedFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Fallback is set for the file in the root of the content directory
+	// when some mentions could not be saved according to their targets
+	Fallback bool  `json:"fallback,omitempty"`
+	Mentions []int `json:"mentions"`
+}
+
+// add records the mention as fetched and to be saved to the file.
+func (p *plan) add(m mention.Mention, fn string, fallback bool) {
+	if f, ok := p.files[fn]; ok {
+		for _, id := range f.Mentions {
+			if id == m.ID() {
+				return
+			}
+		}
+	}
+	p.Mentions = append(p.Mentions, plannedMention{m.ID(), m.Source(), m.Target()})
+	summary.New++
+
+	if p.files == nil {
+		p.files = map[string]*plannedFile{}
+	}
+	f, ok := p.files[fn]
+	if !ok {
+		f = &plannedFile{Path: fn, Action: "modify"}
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			f.Action = "create"
+		}
+		p.files[fn] = f
+		p.Files = append(p.Files, f)
+	}
+	f.Fallback = f.Fallback || fallback
+	f.Mentions = append(f.Mentions, m.ID())
+}
+
+// report prints the plan.
+func (p *plan) report(w io.Writer) {
+	fmt.Fprintln(w, "Dry run, nothing was saved.")
+	fmt.Fprintf(w, "Would save %d new webmentions:\n", len(p.Mentions))
+	for _, m := range p.Mentions {
+		fmt.Fprintf(w, "  %d %s -> %s\n", m.ID, m.Source, m.Target)
+	}
+	for _, f := range p.Files {
+		var note string
+		if f.Fallback {
+			note = ", some with no page found"
+		}
+		fmt.Fprintf(w, "Would %s %s (%d webmentions%s).\n", f.Action, f.Path, len(f.Mentions), note)
+	}
+}
+
+// save writes the plan to the file as JSON.
+func (p *plan) save(fn string) error {
+	if p.Mentions == nil {
+		p.Mentions = []plannedMention{}
+	}
+	if p.Files == nil {
+		p.Files = []*plannedFile{}
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return safefile.Write(fn, append(b, '\n'), 0)
+}
+
+// dryStore plans saving the mentions to the store instead of saving them.
+type dryStore struct {
+	Store
+	c cfg
+}
+
+func (s *dryStore) Close() error {
+	closeStore(s.Store)
+	return nil
+}
+
+func (s *dryStore) Append(mm []mention.Mention) error {
+	for _, m := range mm {
+		switch {
+		case s.c.database != "":
+			s.c.plan.add(m, s.c.database, false)
+		case s.c.contentDir != "":
+			s.planPage(m)
+		default:
+			s.c.plan.add(m, s.c.filename, false)
+		}
+	}
+	return nil
+}
+
+// planPage plans saving the mention the way dirStore would: to the page
+// file if the page's directory exists, or to the file in the root of the
+// content directory otherwise, unless the mention is there already.
+func (s *dryStore) planPage(m mention.Mention) {
+	fn := pageFile(m, s.c)
+	fallback := fn == ""
+	if !fallback {
+		if fi, err := os.Stat(filepath.Dir(fn)); err != nil || !fi.IsDir() {
+			fallback = true
+		}
+	}
+	if fallback {
+		fn = filepath.Join(s.c.contentDir, s.c.filename)
+	}
+
+	existing, _ := readFile(fn)
+	if contains(existing, m) {
+		return
+	}
+	s.c.plan.add(m, fn, fallback)
+}
+
+// Replace does nothing, the only command that replaces mentions reports
+// the changes itself.
+func (s *dryStore) Replace([]mention.Mention) error {
+	return nil
+}
+
+func (s *dryStore) SaveState(syncState) error {
+	return nil
+}
+
+func contains(mm []mention.Mention, m mention.Mention) bool {
+	for _, e := range mm {
+		if sameMention(e, m) {
+			return true
+		}
+	}
+	return false
+}
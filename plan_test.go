@@ -0,0 +1,83 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"links":[`+
+			`{"id":1,"source":"https://src.example/1","target":"https://example.org/post/","verified_date":"2021-06-07T22:21:11Z"},`+
+			`{"id":2,"source":"https://src.example/2","target":"https://example.org/missing/","verified_date":"2021-06-07T22:21:12Z"},`+
+			`{"id":3,"source":"https://src.example/3","target":"https://example.org/post/","verified_date":"2021-06-07T22:21:13Z"}]}`)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	content := filepath.Join(dir, "content")
+	if err := os.MkdirAll(filepath.Join(content, "post"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	planFile := filepath.Join(dir, "plan.json")
+
+	if err := run(context.Background(), []string{"-api", ts.URL, "-cd", content, "-plan", planFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := filepath.Walk(content, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			t.Errorf("dry run saved %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(planFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got plan
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Mentions) != 3 {
+		t.Fatalf("want 3 mentions planned, got %d", len(got.Mentions))
+	}
+	want := []*plannedFile{
+		{Path: filepath.Join(content, "post", "webmentions.json"), Action: "create", Mentions: []int{1, 3}},
+		{Path: filepath.Join(content, "webmentions.json"), Action: "create", Fallback: true, Mentions: []int{2}},
+	}
+	if !reflect.DeepEqual(got.Files, want) {
+		t.Fatalf("want files %+v, got %+v", want, got.Files)
+	}
+}
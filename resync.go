@@ -0,0 +1,186 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+// tombstoneKey marks a mention that is no longer available from the API,
+// the value is the time the deletion was detected.
+const tombstoneKey = "_deleted"
+
+// changes is the difference between the archive and the API.
+type changes struct {
+	added []mention.Mention
+	// updated are the changed mentions as they are now
+	updated []mention.Mention
+	// deleted are the tombstones of the deleted mentions
+	deleted []mention.Mention
+	// replaced are the mentions to archive in place of the changed ones,
+	// according to the duplicates policy
+	replaced []mention.Mention
+}
+
+// resync fetches all the mentions (or the ones of the targets) and compares
+// them to the archive by ID, reporting the differences, and applying them
+// if configured to.
+func resync(ctx context.Context, c cfg) error {
+	tt := targets(c)
+	var remote []mention.Mention
+	var err error
+	if len(tt) > 0 {
+		remote, err = getTargets(ctx, c, tt)
+	} else {
+		remote, err = getNew(ctx, endpointUrl(c), nil, fetching(c))
+	}
+	if err != nil {
+		return err
+	}
+
+	s := newStore(c)
+	defer closeStore(s)
+	all, err := s.All()
+	if err != nil {
+		return err
+	}
+	// only the mentions fetched can be compared, the archive may be shared
+	// with the other domains
+	local := all
+	dd := domains(c)
+	if len(tt) > 0 || len(dd) == 1 {
+		local = nil
+		for _, m := range all {
+			if len(tt) > 0 && !isTarget(m, tt) || len(dd) == 1 && domainOf(m) != dd[0] {
+				continue
+			}
+			local = append(local, m)
+		}
+	}
+
+	ch := diff(local, remote, time.Now(), c.duplicates)
+	ch.report(os.Stdout)
+	if ch.empty() {
+		return nil
+	}
+	if !c.apply {
+		fmt.Println("Run with -apply to update the archive.")
+		return nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.Replace(append(ch.replaced, ch.deleted...)); err != nil {
+		return err
+	}
+	if len(ch.added) == 0 {
+		return nil
+	}
+	if len(tt) > 0 {
+		// the newer mentions of the other pages are still to be fetched,
+		// so the state stays as it was
+		return s.Append(ch.added)
+	}
+	return archive(s, ch.added)
+}
+
+// diff compares the archived mentions to the ones from the API, all the
+// changed ones are reported, but only replaced according to the duplicates
+// policy. Mentions without IDs (i.e. the timestamp) are ignored.
+func diff(local, remote []mention.Mention, now time.Time, policy string) (ch changes) {
+	archived := map[int]mention.Mention{}
+	for _, m := range local {
+		if id := m.ID(); id != 0 {
+			archived[id] = m
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, m := range remote {
+		id := m.ID()
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		a, ok := archived[id]
+		switch {
+		case !ok:
+			ch.added = append(ch.added, m)
+		case isTombstone(a):
+			// the mention is back
+			r := withoutHistory(m)
+			if h, ok := a[historyKey]; ok {
+				r[historyKey] = h
+			}
+			ch.updated = append(ch.updated, m)
+			ch.replaced = append(ch.replaced, r)
+		case !sameContent(a, m):
+			ch.updated = append(ch.updated, m)
+			if r, ok := resolve(a, m, policy); ok {
+				ch.replaced = append(ch.replaced, r)
+			}
+		}
+	}
+
+	for _, m := range local {
+		id := m.ID()
+		if id == 0 || seen[id] || isTombstone(m) {
+			continue
+		}
+		seen[id] = true
+		ch.deleted = append(ch.deleted, tombstone(m, now))
+	}
+	return
+}
+
+func (ch changes) empty() bool {
+	return len(ch.added)+len(ch.updated)+len(ch.deleted) == 0
+}
+
+// report prints the changes, one mention per line.
+func (ch changes) report(w io.Writer) {
+	fmt.Fprintf(w, "%d added, %d updated, %d deleted webmentions.\n", len(ch.added), len(ch.updated), len(ch.deleted))
+	for _, l := range []struct {
+		mark string
+		mm   []mention.Mention
+	}{{"+", ch.added}, {"~", ch.updated}, {"-", ch.deleted}} {
+		for _, m := range l.mm {
+			fmt.Fprintf(w, "%s %d %s -> %s\n", l.mark, m.ID(), m.Source(), m.Target())
+		}
+	}
+}
+
+func isTombstone(m mention.Mention) bool {
+	_, ok := m[tombstoneKey]
+	return ok
+}
+
+// tombstone returns a copy of the mention marked as deleted.
+func tombstone(m mention.Mention, now time.Time) mention.Mention {
+	t := mention.Mention{}
+	for k, v := range m {
+		t[k] = v
+	}
+	t[tombstoneKey] = now.UTC().Format(time.RFC3339)
+	return t
+}
@@ -0,0 +1,221 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+func resyncMention(id int, content string) string {
+	return fmt.Sprintf(`{"id":%d,"source":"https://src.example/%d","target":"https://example.org/post/","verified_date":"2021-06-07T22:21:1%dZ","content":"%s"}`, id, id, id%10, content)
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Date(2021, 6, 8, 0, 0, 0, 0, time.UTC)
+	local := mustParse(t, `[`+resyncMention(1, "same")+`,`+resyncMention(2, "old")+`,`+resyncMention(3, "gone")+`,{"timestamp":"2021-06-07T22:21:13Z"}]`)
+	gone := tombstone(local[2], now)
+	remote := mustParse(t, `[`+resyncMention(1, "same")+`,`+resyncMention(2, "new")+`,`+resyncMention(4, "added")+`]`)
+
+	ch := diff(local, remote, now, replaceOld)
+	if len(ch.added) != 1 || ch.added[0].ID() != 4 {
+		t.Fatalf("want mention 4 added, got %v", ch.added)
+	}
+	if len(ch.updated) != 1 || ch.updated[0].Content() != "new" {
+		t.Fatalf("want mention 2 updated, got %v", ch.updated)
+	}
+	if len(ch.deleted) != 1 || ch.deleted[0][tombstoneKey] != "2021-06-08T00:00:00Z" {
+		t.Fatalf("want tombstone for mention 3, got %v", ch.deleted)
+	}
+
+	// tombstones stay as they are, unless the mention is back
+	ch = diff([]mention.Mention{gone}, nil, now, keepOld)
+	if !ch.empty() {
+		t.Fatalf("want no changes, got %+v", ch)
+	}
+	ch = diff([]mention.Mention{gone}, local[2:3], now, keepOld)
+	if len(ch.updated) != 1 || len(ch.replaced) != 1 || isTombstone(ch.replaced[0]) {
+		t.Fatalf("want mention 3 restored, got %+v", ch)
+	}
+
+	// the changed mentions are always reported, but replaced according to
+	// the policy
+	ch = diff(local, remote, now, keepOld)
+	if len(ch.updated) != 1 || len(ch.replaced) != 0 || len(ch.added) != 1 {
+		t.Fatalf("want mention 2 reported and kept, got %+v", ch)
+	}
+	ch = diff(local, remote, now, keepHistory)
+	if len(ch.replaced) != 1 || ch.replaced[0].Content() != "new" {
+		t.Fatalf("want mention 2 replaced, got %+v", ch)
+	}
+	if hist, _ := ch.replaced[0][historyKey].([]interface{}); len(hist) != 1 {
+		t.Fatalf("want the archived version in the history, got %v", ch.replaced[0][historyKey])
+	}
+}
+
+func TestResync(t *testing.T) {
+	remote := `{"links":[` + resyncMention(1, "same") + `,` + resyncMention(2, "new") + `,` + resyncMention(4, "added") + `]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since_id") != "" {
+			t.Errorf("want full fetch, got since_id %s", r.URL.Query().Get("since_id"))
+		}
+		if r.URL.Query().Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		fmt.Fprint(w, remote)
+	}))
+	defer ts.Close()
+
+	local := mustParse(t, `[`+resyncMention(1, "same")+`,`+resyncMention(2, "old")+`,`+resyncMention(3, "gone")+`]`)
+
+	tests := map[string]func(dir string) cfg{
+		"file": func(dir string) cfg {
+			return cfg{filename: filepath.Join(dir, "wm.json")}
+		},
+		"content dir": func(dir string) cfg {
+			return cfg{filename: "wm.json", contentDir: dir}
+		},
+		"database": func(dir string) cfg {
+			return cfg{filename: "wm.json", database: filepath.Join(dir, "wm.sqlite")}
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := tc(dir)
+			c.api, c.duplicates = ts.URL, replaceOld
+			if c.contentDir != "" {
+				// the mentions of the post are in the page bundle
+				if err := os.MkdirAll(filepath.Join(dir, "post"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := archive(newStore(c), local); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := resync(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			if got := resyncContents(t, c); got != "1:same 2:old 3:gone" {
+				t.Fatalf("archive changed without -apply: %s", got)
+			}
+
+			c.apply = true
+			if err := resync(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resyncContents(t, c), "1:same 2:new 3:gone(deleted) 4:added"; got != want {
+				t.Fatalf("want %s, got %s", want, got)
+			}
+
+			// nothing changes on the second run
+			if err := resync(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resyncContents(t, c), "1:same 2:new 3:gone(deleted) 4:added"; got != want {
+				t.Fatalf("want %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+func resyncContents(t *testing.T, c cfg) string {
+	t.Helper()
+	mm, err := newStore(c).All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(mm, func(i, j int) bool { return mm[i].ID() < mm[j].ID() })
+	var s string
+	for _, m := range mm {
+		if s != "" {
+			s += " "
+		}
+		s += fmt.Sprintf("%d:%s", m.ID(), m.Content())
+		if isTombstone(m) {
+			s += "(deleted)"
+		}
+	}
+	return s
+}
+
+func TestResyncTarget(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("target"); got != "https://example.org/post/" {
+			t.Errorf("want the post's webmentions only, got target %q", got)
+		}
+		if r.URL.Query().Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"links":[`+resyncMention(1, "same")+`,`+resyncMention(2, "new")+`]}`)
+	}))
+	defer ts.Close()
+
+	other := `{"id":5,"source":"https://src.example/5","target":"https://example.org/other/","verified_date":"2021-06-07T22:21:15Z","content":"other"}`
+	local := mustParse(t, `[`+resyncMention(1, "same")+`,`+resyncMention(2, "old")+`,`+resyncMention(3, "gone")+`,`+other+`]`)
+	c := cfg{api: ts.URL, filename: filepath.Join(t.TempDir(), "wm.json"), target: "https://example.org/post/", apply: true, duplicates: replaceOld}
+	if err := archive(newStore(c), local); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resync(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resyncContents(t, c), "1:same 2:new 3:gone(deleted) 5:other"; got != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestResyncDomain(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("domain"); got != "example.org" {
+			t.Errorf("want the domain's webmentions only, got domain %q", got)
+		}
+		if r.URL.Query().Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"links":[`+resyncMention(1, "same")+`]}`)
+	}))
+	defer ts.Close()
+
+	other := `{"id":5,"source":"https://src.example/5","target":"https://example.com/post/","verified_date":"2021-06-07T22:21:15Z","content":"other"}`
+	local := mustParse(t, `[`+resyncMention(1, "same")+`,`+other+`]`)
+	c := cfg{api: ts.URL, filename: filepath.Join(t.TempDir(), "wm.json"), domain: "example.org", apply: true}
+	if err := archive(newStore(c), local); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := resync(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resyncContents(t, c), "1:same 5:other"; got != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
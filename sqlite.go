@@ -0,0 +1,298 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS mentions (
+	id       INTEGER PRIMARY KEY,
+	source   TEXT,
+	target   TEXT,
+	property TEXT,
+	received TEXT,
+	data     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mentions_target ON mentions (target);
+CREATE INDEX IF NOT EXISTS mentions_received ON mentions (received);`
+
+// sqliteStore keeps the mentions in an SQLite database, one row per
+// mention, along with the raw JSON of the mention.
+type sqliteStore struct {
+	c  cfg
+	db *sql.DB
+}
+
+func (s *sqliteStore) open() (*sql.DB, error) {
+	if s.db != nil {
+		return s.db, nil
+	}
+	db, err := sql.Open("sqlite", s.c.database)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", s.c.database, err)
+	}
+	s.db = db
+	return db, nil
+}
+
+// Close closes the database, if it was opened.
+func (s *sqliteStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *sqliteStore) Load() (mm []mention.Mention, err error) {
+	db, err := s.open()
+	if err != nil {
+		return
+	}
+	rows, err := db.Query("SELECT data FROM mentions ORDER BY id")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return
+		}
+		var m mention.Mention
+		if err = json.Unmarshal([]byte(data), &m); err != nil {
+			return
+		}
+		mm = append(mm, m)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqliteStore) Append(mm []mention.Mention) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	get, err := tx.Prepare(`SELECT data FROM mentions WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer get.Close()
+	insert, err := tx.Prepare(`INSERT INTO mentions (id, source, target, property, received, data)
+		VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	update, err := tx.Prepare(`UPDATE mentions SET source = ?, target = ?, property = ?, received = ?, data = ?
+		WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+
+	var added, updated int
+	for _, m := range mm {
+		row, err := sqliteRow(m)
+		if err != nil {
+			return err
+		}
+		var data string
+		err = get.QueryRow(row[0]).Scan(&data)
+		if errors.Is(err, sql.ErrNoRows) {
+			if _, err := insert.Exec(row...); err != nil {
+				return err
+			}
+			added++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var a mention.Mention
+		if err := json.Unmarshal([]byte(data), &a); err != nil {
+			return err
+		}
+		r, ok := resolve(a, m, s.c.duplicates)
+		if !ok {
+			continue
+		}
+		if row, err = sqliteRow(r); err != nil {
+			return err
+		}
+		if _, err := update.Exec(append(row[1:], row[0])...); err != nil {
+			return err
+		}
+		updated++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if added+updated > 0 {
+		summary.New += added
+		summary.wrote(s.c.database)
+	}
+	slog.Info("saved new webmentions", "count", added, "updated", updated, "database", s.c.database)
+	return nil
+}
+
+func (s *sqliteStore) All() ([]mention.Mention, error) {
+	return s.Load()
+}
+
+func (s *sqliteStore) Replace(mm []mention.Mention) error {
+	db, err := s.open()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE mentions SET source = ?, target = ?, property = ?, received = ?, data = ?
+		WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var n int64
+	for _, m := range mm {
+		row, err := sqliteRow(m)
+		if err != nil {
+			return err
+		}
+		res, err := stmt.Exec(append(row[1:], row[0])...)
+		if err != nil {
+			return err
+		}
+		if a, err := res.RowsAffected(); err == nil {
+			n += a
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n > 0 {
+		summary.wrote(s.c.database)
+	}
+	slog.Info("replaced webmentions", "count", n, "database", s.c.database)
+	return nil
+}
+
+// sqliteRow returns the values of the mentions table columns for a mention.
+func sqliteRow(m mention.Mention) ([]interface{}, error) {
+	id := m.ID()
+	if id == 0 {
+		return nil, fmt.Errorf("mention has no ID: %v", m)
+	}
+
+	var bb bytes.Buffer
+	enc := json.NewEncoder(&bb)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+
+	var received interface{}
+	if t := m.Received(); !t.IsZero() {
+		received = t.UTC().Format(time.RFC3339)
+	}
+
+	return []interface{}{
+		id,
+		m.Source(),
+		m.Target(),
+		m.Property(),
+		received,
+		string(bytes.TrimSpace(bb.Bytes())),
+	}, nil
+}
+
+// LoadState reads the state file, but the last IDs and timestamps are
+// always derived from the mentions in the database, in case it was restored
+// from a backup.
+func (s *sqliteStore) LoadState() (st syncState, err error) {
+	if st, _, err = readState(stateFile(s.c)); err != nil {
+		return
+	}
+	db, err := s.open()
+	if err != nil {
+		return
+	}
+	var id sql.NullInt64
+	var received sql.NullString
+	err = db.QueryRow("SELECT MAX(id), MAX(received) FROM mentions").Scan(&id, &received)
+	if err != nil {
+		return
+	}
+	st.LastID, st.Timestamp = int(id.Int64), time.Time{}
+	if received.Valid {
+		if st.Timestamp, err = time.Parse(time.RFC3339, received.String); err != nil {
+			return
+		}
+	}
+
+	rows, err := db.Query("SELECT target, MAX(id), MAX(received) FROM mentions GROUP BY target")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	st.Domains = map[string]domainState{}
+	for rows.Next() {
+		var target string
+		if err = rows.Scan(&target, &id, &received); err != nil {
+			return
+		}
+		var t time.Time
+		if received.Valid {
+			t, _ = time.Parse(time.RFC3339, received.String)
+		}
+		advanceDomain(st.Domains, domainOf(mention.Mention{"target": target}), int(id.Int64), t)
+	}
+	err = rows.Err()
+	return
+}
+
+func (s *sqliteStore) SaveState(st syncState) error {
+	return writeState(stateFile(s.c), st)
+}
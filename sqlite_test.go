@@ -0,0 +1,86 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+func TestSqliteStore(t *testing.T) {
+	var all []mention.Mention
+	for _, fn := range []string{"page.json", "jf2.json"} {
+		mm, err := readFile(filepath.Join("testdata", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, mm...)
+	}
+
+	c := cfg{database: filepath.Join(t.TempDir(), "wm.sqlite")}
+	if err := archive(newStore(c), all); err != nil {
+		t.Fatal(err)
+	}
+	// appending the same mentions again must not duplicate them
+	s := newStore(c)
+	if err := archive(s, all[:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(all) {
+		t.Fatalf("want %d mentions, got %d", len(all), len(got))
+	}
+
+	st, err := s.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastID != findLast(all) {
+		t.Fatalf("want last ID %d, got %d", findLast(all), st.LastID)
+	}
+
+	db := s.(*sqliteStore).db
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM mentions WHERE property = 'like-of'").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatalf("no likes found by property")
+	}
+
+	closeStore(s)
+	if err := db.Ping(); err == nil {
+		t.Fatal("database left open")
+	}
+	// reopened when used again
+	if got, err = s.Load(); err != nil || len(got) != len(all) {
+		t.Fatalf("want %d mentions after reopening, got %d (%v)", len(all), len(got), err)
+	}
+	closeStore(s)
+}
+
+func TestSqliteStoreNoID(t *testing.T) {
+	c := cfg{database: filepath.Join(t.TempDir(), "wm.sqlite")}
+	if err := newStore(c).Append([]mention.Mention{{"source": "x"}}); err == nil {
+		t.Fatalf("want error for a mention without ID")
+	}
+}
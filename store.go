@@ -0,0 +1,506 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
+)
+
+// Store is an archive of webmentions.
+type Store interface {
+	// Load returns the mentions already in the archive.
+	Load() ([]mention.Mention, error)
+	// Append adds new mentions to the archive.
+	Append(mm []mention.Mention) error
+	// All returns all the mentions in the archive, wherever they are kept.
+	All() ([]mention.Mention, error)
+	// Replace replaces the archived mentions with the ones with the same
+	// IDs.
+	Replace(mm []mention.Mention) error
+	// LoadState returns the state of the last sync.
+	LoadState() (syncState, error)
+	// SaveState records the state of a sync.
+	SaveState(st syncState) error
+}
+
+// syncState is what we need to know to only fetch new mentions. It is
+// kept in the state file next to the archive.
+type syncState struct {
+	LastID    int       `json:"last_id"`
+	Timestamp time.Time `json:"last_received"`
+	LastRun   time.Time `json:"last_run"`
+	// Domains are the cursors for each of the target domains
+	Domains map[string]domainState `json:"domains,omitempty"`
+}
+
+// domainState is the sync state for the mentions of a single domain.
+type domainState struct {
+	LastID    int       `json:"last_id"`
+	Timestamp time.Time `json:"last_received"`
+}
+
+// advance returns the state updated to cover the mentions.
+func (st syncState) advance(mm []mention.Mention) syncState {
+	if id := findLast(mm); id > st.LastID {
+		st.LastID = id
+	}
+	dd := make(map[string]domainState, len(st.Domains))
+	for d, ds := range st.Domains {
+		dd[d] = ds
+	}
+	for _, m := range mm {
+		t := m.Received()
+		if t.After(st.Timestamp) {
+			st.Timestamp = t
+		}
+		advanceDomain(dd, domainOf(m), m.ID(), t)
+	}
+	if len(dd) > 0 {
+		st.Domains = dd
+	}
+	return st
+}
+
+func advanceDomain(dd map[string]domainState, d string, id int, t time.Time) {
+	if d == "" {
+		return
+	}
+	ds := dd[d]
+	if id > ds.LastID {
+		ds.LastID = id
+	}
+	if t.After(ds.Timestamp) {
+		ds.Timestamp = t
+	}
+	dd[d] = ds
+}
+
+// forDomain returns the state of the mentions of the domain only, so that
+// the archive shared by several domains fetched separately misses none.
+func (st syncState) forDomain(d string) syncState {
+	ds := st.Domains[d]
+	return syncState{LastID: ds.LastID, Timestamp: ds.Timestamp}
+}
+
+// cursor returns what to fetch the new mentions since: the last ID, or the
+// timestamp if the config says so.
+func (st syncState) cursor(c cfg) interface{} {
+	if c.timestamp {
+		return st.Timestamp
+	}
+	return st.LastID
+}
+
+// covers tells whether the mention must have been fetched already.
+func (st syncState) covers(m mention.Mention, c cfg) bool {
+	if c.timestamp {
+		return !m.Received().After(st.Timestamp)
+	}
+	return m.ID() <= st.LastID
+}
+
+// missingOK treats a missing archive as an empty one, but not the one that
+// can not be read.
+func missingOK(err error) error {
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// archivePath returns the path of the archive: the database, the file, or
+// the file in the root of the content directory.
+func archivePath(c cfg) string {
+	switch {
+	case c.database != "":
+		return c.database
+	case c.contentDir != "":
+		return filepath.Join(c.contentDir, c.filename)
+	default:
+		return c.filename
+	}
+}
+
+// stateFile returns the file to keep the sync state of the archive in.
+func stateFile(c cfg) string {
+	return archivePath(c) + ".state"
+}
+
+// readState reads the sync state from the file, ok tells whether there
+// was one.
+func readState(fn string) (st syncState, ok bool, err error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return st, false, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(b, &st); err != nil {
+		return st, false, fmt.Errorf("%s: %w", fn, err)
+	}
+	return st, true, nil
+}
+
+// writeState records the sync state in the file as of now.
+func writeState(fn string, st syncState) error {
+	st.LastRun = time.Now().UTC()
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return safefile.Write(fn, append(b, '\n'), 0)
+}
+
+func newStore(c cfg) Store {
+	var s Store
+	switch {
+	case c.database != "":
+		s = &sqliteStore{c: c}
+	case c.contentDir != "":
+		s = &dirStore{c: c}
+	default:
+		s = &fileStore{c: c}
+	}
+	if c.plan != nil {
+		return &dryStore{s, c}
+	}
+	return s
+}
+
+// closeStore releases what the store keeps open, i.e. the database.
+func closeStore(s Store) {
+	c, ok := s.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		slog.Warn("could not close the archive", "err", err)
+	}
+}
+
+// archive appends the new mentions to the store and records the sync.
+func archive(s Store, mm []mention.Mention) error {
+	st, err := s.LoadState()
+	if err != nil {
+		return err
+	}
+	if err := s.Append(mm); err != nil {
+		return err
+	}
+	return s.SaveState(st.advance(mm))
+}
+
+// fileStore keeps all the mentions in a single file.
+type fileStore struct {
+	c      cfg
+	mm     []mention.Mention
+	format archiveFormat
+	loaded bool
+}
+
+func (s *fileStore) Load() (mm []mention.Mention, err error) {
+	if !s.loaded {
+		s.mm, s.format, err = readArchive(s.c.filename)
+		s.loaded = true
+	}
+	return s.mm, err
+}
+
+func (s *fileStore) Append(mm []mention.Mention) error {
+	if s.c.jsonl && !s.loaded {
+		if done, err := s.appendLines(mm); done || err != nil {
+			return err
+		}
+	}
+	existing, err := s.Load()
+	if err = missingOK(err); err != nil {
+		return err
+	}
+	all, added, updated := merge(existing, mm, s.c.duplicates)
+	if added+updated == 0 {
+		slog.Info("all the webmentions are archived already", "count", len(mm))
+		return nil
+	}
+	slog.Info("appending new webmentions", "count", added, "updated", updated)
+	if updated == 0 {
+		err = addToFile(existing, all[len(existing):], s.format, s.c)
+	} else {
+		err = writeFile(all, s.c)
+	}
+	if err != nil {
+		return err
+	}
+	summary.New += added
+	s.mm, s.format = all, formatOf(s.c)
+	slog.Info("saved webmentions", "count", len(all), "file", s.c.filename)
+	return nil
+}
+
+// appendLines adds the new mentions to a JSON Lines file, only scanning the
+// file for the ones archived already instead of reading it in memory. It's
+// not done if the file is not in JSON Lines format, or some of the mentions
+// are archived already and may have to be replaced.
+func (s *fileStore) appendLines(mm []mention.Mention) (done bool, err error) {
+	x := newIndex()
+	var n int
+	ok, err := scanLines(s.c.filename, func(m mention.Mention) {
+		x.add(m, n)
+		n++
+	})
+	if os.IsNotExist(err) {
+		ok, err = true, nil
+	}
+	if !ok || err != nil {
+		return false, err
+	}
+
+	var added []mention.Mention
+	for _, m := range mm {
+		if x.find(m) >= 0 {
+			if s.c.duplicates == replaceOld || s.c.duplicates == keepHistory {
+				return false, nil
+			}
+			continue
+		}
+		x.add(m, n)
+		n++
+		added = append(added, m)
+	}
+	if len(added) == 0 {
+		slog.Info("all the webmentions are archived already", "count", len(mm))
+		return true, nil
+	}
+	slog.Info("appending new webmentions", "count", len(added), "updated", 0)
+	if err := writeLines(added, s.c, true); err != nil {
+		return true, err
+	}
+	summary.New += len(added)
+	slog.Info("saved webmentions", "count", n, "file", s.c.filename)
+	return true, nil
+}
+
+func (s *fileStore) All() ([]mention.Mention, error) {
+	return s.Load()
+}
+
+func (s *fileStore) Replace(mm []mention.Mention) error {
+	existing, err := s.Load()
+	if err != nil {
+		return err
+	}
+	all, n := replaceByID(existing, mm)
+	if n == 0 {
+		return nil
+	}
+	c := s.format.rewrite(s.c)
+	if err := writeFile(all, c); err != nil {
+		return err
+	}
+	s.mm, s.format = all, formatOf(c)
+	slog.Info("replaced webmentions", "count", n, "file", s.c.filename)
+	return nil
+}
+
+// LoadState reads the state file, but the last IDs are always derived from
+// the mentions in the file, in case it was restored from a backup.
+func (s *fileStore) LoadState() (syncState, error) {
+	st, _, err := readState(stateFile(s.c))
+	if err != nil {
+		return st, err
+	}
+	if s.c.jsonl && !s.loaded {
+		fresh, ts := syncState{}, time.Time{}
+		ok, err := scanLines(s.c.filename, func(m mention.Mention) {
+			fresh = fresh.advance([]mention.Mention{m})
+			if t, ok := parseTimestamp(m); ok && t.After(ts) {
+				ts = t
+			}
+		})
+		if ok {
+			st.LastID, st.Domains = fresh.LastID, fresh.Domains
+			if ts.After(st.Timestamp) {
+				st.Timestamp = ts
+			}
+			return st, nil
+		}
+		if err = missingOK(err); err != nil {
+			return st, err
+		}
+	}
+	mm, err := s.Load()
+	if err = missingOK(err); err != nil {
+		return st, err
+	}
+	fresh := syncState{}.advance(mm)
+	st.LastID, st.Domains = fresh.LastID, fresh.Domains
+	if t := getTimestamp(mm); t.After(st.Timestamp) {
+		st.Timestamp = t
+	}
+	return st, nil
+}
+
+func (s *fileStore) SaveState(st syncState) error {
+	return writeState(stateFile(s.c), st)
+}
+
+// dirStore saves mentions to separate files according to their targets'
+// paths in the content directory, falling back to the file in the root
+// of the content directory for the mentions it can not place.
+type dirStore struct {
+	c cfg
+}
+
+func (s *dirStore) root() string {
+	return filepath.Join(s.c.contentDir, s.c.filename)
+}
+
+func (s *dirStore) Load() ([]mention.Mention, error) {
+	return readFile(s.root())
+}
+
+func (s *dirStore) Append(mm []mention.Mention) error {
+	for _, m := range mm {
+		if !saveToDir(m, s.c) {
+			if err := saveToContentDir(m, s.c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// All returns the mentions from all the files in the content directory.
+func (s *dirStore) All() (all []mention.Mention, err error) {
+	err = walkArchive(s.c, func(fn string) error {
+		mm, err := readFile(fn)
+		all = append(all, mm...)
+		return err
+	})
+	return
+}
+
+func (s *dirStore) Replace(mm []mention.Mention) error {
+	return walkArchive(s.c, func(fn string) error {
+		existing, f, err := readArchive(fn)
+		if err != nil {
+			return err
+		}
+		all, n := replaceByID(existing, mm)
+		if n == 0 {
+			return nil
+		}
+		c := f.rewrite(s.c)
+		c.filename = fn
+		if err := writeFile(all, c); err != nil {
+			return err
+		}
+		slog.Info("replaced webmentions", "count", n, "file", fn)
+		return nil
+	})
+}
+
+// LoadState reads the state file. Without one, the last ID is derived from
+// all the files in the content directory, and the timestamp from the file
+// in its root, where it used to be kept.
+func (s *dirStore) LoadState() (syncState, error) {
+	st, ok, err := readState(stateFile(s.c))
+	if ok || err != nil {
+		return st, err
+	}
+	mm, err := s.Load()
+	if err = missingOK(err); err != nil {
+		return st, err
+	}
+	st = syncState{LastID: findLast(mm), Timestamp: getTimestamp(mm)}
+	all, err := s.All()
+	if err = missingOK(err); err != nil {
+		return st, err
+	}
+	return st.advance(all), nil
+}
+
+// SaveState writes the state file, and removes the timestamp from the file
+// in the root of the content directory if it's there.
+func (s *dirStore) SaveState(st syncState) error {
+	if err := writeState(stateFile(s.c), st); err != nil {
+		return err
+	}
+
+	mm, f, err := readArchive(s.root())
+	if err != nil {
+		return missingOK(err)
+	}
+	var clean []mention.Mention
+	for _, m := range mm {
+		if _, ok := parseTimestamp(m); !ok {
+			clean = append(clean, m)
+		}
+	}
+	if len(clean) == len(mm) {
+		return nil
+	}
+	slog.Info("moved the timestamp to the state file", "file", s.root())
+	c := f.rewrite(s.c)
+	c.filename = s.root()
+	return writeFile(clean, c)
+}
+
+// walkArchive calls fn for each of the files in the content directory that
+// the content directory store can write.
+func walkArchive(c cfg, fn func(path string) error) error {
+	return filepath.Walk(c.contentDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isArchiveFile(info.Name(), c) {
+			return nil
+		}
+		return fn(path)
+	})
+}
+
+// replaceByID returns the mentions with the ones having the same IDs as
+// the replacements replaced, and the number of mentions replaced.
+func replaceByID(mm, replacements []mention.Mention) ([]mention.Mention, int) {
+	byID := map[int]mention.Mention{}
+	for _, r := range replacements {
+		if id := r.ID(); id != 0 {
+			byID[id] = r
+		}
+	}
+
+	res := make([]mention.Mention, len(mm))
+	var n int
+	for i, m := range mm {
+		if r, ok := byID[m.ID()]; ok && m.ID() != 0 {
+			m = r
+			n++
+		}
+		res[i] = m
+	}
+	return res, n
+}
@@ -0,0 +1,175 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+func TestFileStore(t *testing.T) {
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join("testdata", "test_store.json")
+	defer os.Remove(fn)
+	defer os.Remove(stateFile(cfg{filename: fn}))
+
+	s := newStore(cfg{filename: fn, tlo: true})
+	if err := archive(s, mm[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive(newStore(cfg{filename: fn, tlo: true}), mm[2:]); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStore(cfg{filename: fn})
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(mm) {
+		t.Fatalf("want %d mentions, got %d", len(mm), len(got))
+	}
+
+	st, err := s.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastID != findLast(mm) {
+		t.Fatalf("want last ID %d, got %d", findLast(mm), st.LastID)
+	}
+	if st.LastRun.IsZero() {
+		t.Fatal("last run not recorded")
+	}
+	if d, ok := st.Domains["evgenykuznetsov.org"]; !ok || d.LastID != findLast(mm) {
+		t.Fatalf("wrong domain cursors: %+v", st.Domains)
+	}
+}
+
+func TestFileStoreLines(t *testing.T) {
+	mm, err := readFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cfg{filename: filepath.Join(t.TempDir(), "webmentions.jsonl"), jsonl: true}
+	if err := archive(newStore(c), mm[:2]); err != nil {
+		t.Fatal(err)
+	}
+	s := &fileStore{c: c}
+	// one of them archived already
+	if err := archive(s, mm[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if s.loaded {
+		t.Fatal("JSON Lines file read in memory")
+	}
+	st, err := s.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastID != findLast(mm) {
+		t.Fatalf("want last ID %d, got %d", findLast(mm), st.LastID)
+	}
+	got, err := readFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(mm) {
+		t.Fatalf("want %d mentions, got %d", len(mm), len(got))
+	}
+
+	// the changed ones are replaced in the file
+	c.duplicates = replaceOld
+	m := mention.Mention{}
+	for k, v := range mm[0] {
+		m[k] = v
+	}
+	m["verified_date"] = "2030-01-01T00:00:00Z"
+	if err := archive(&fileStore{c: c}, []mention.Mention{m}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = readFile(c.filename); len(got) != len(mm) || got[0]["verified_date"] != m["verified_date"] {
+		t.Fatalf("want mention %d replaced, got %v", m.ID(), got[0])
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	c := cfg{contentDir: t.TempDir(), filename: "webmentions.json", tlo: true}
+	root := filepath.Join(c.contentDir, c.filename)
+	old := []mention.Mention{
+		{"wm-id": 100.0, "wm-received": "2020-05-01T10:00:00Z", "target": "https://example.org/"},
+		{"timestamp": "2020-05-05T14:54:13Z"},
+	}
+	rc := c
+	rc.filename = root
+	if err := writeFile(old, rc); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newStore(c)
+	st, err := s.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := time.Parse(time.RFC3339, "2020-05-05T14:54:13Z")
+	if st.LastID != 100 || !st.Timestamp.Equal(want) {
+		t.Fatalf("wrong state migrated: %+v", st)
+	}
+	if err := s.SaveState(st); err != nil {
+		t.Fatal(err)
+	}
+
+	mm, err := readFile(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mm) != 1 || !getTimestamp(mm).IsZero() {
+		t.Fatalf("timestamp left in the root file: %v", mm)
+	}
+	got, ok, err := readState(stateFile(c))
+	if err != nil || !ok {
+		t.Fatalf("no state file: %v", err)
+	}
+	if got.LastID != 100 || !got.Timestamp.Equal(want) || got.LastRun.IsZero() {
+		t.Fatalf("wrong state saved: %+v", got)
+	}
+}
+
+func TestDirStoreSaveState(t *testing.T) {
+	c := cfg{contentDir: t.TempDir(), filename: "webmentions.json"}
+	s := newStore(c)
+	// no file in the root is fine
+	if err := s.SaveState(syncState{LastID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(c.contentDir, c.filename)
+	if err := ioutil.WriteFile(root, []byte(`{"links":[{"id":1`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveState(syncState{LastID: 1}); err == nil {
+		t.Fatal("want error for an unreadable root file")
+	}
+}
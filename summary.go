@@ -0,0 +1,131 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/safefile"
+)
+
+// Exit statuses of the program.
+const (
+	exitOK = 0
+	// exitFatal is for errors that made the run fail entirely
+	exitFatal = 1
+	// exitPartial is for runs where some profiles or domains failed
+	exitPartial = 2
+	// exitNoNew is for successful runs with no new webmentions, if asked
+	// for with -nonew
+	exitNoNew = 3
+)
+
+// errNoNew is returned by successful runs that found no new webmentions
+// if the distinct exit status is asked for.
+var errNoNew = errors.New("no new webmentions")
+
+// partialError is returned when some of the profiles or domains failed,
+// but not all of them.
+type partialError struct {
+	error
+}
+
+func (e partialError) Unwrap() error {
+	return e.error
+}
+
+// exitStatus returns the exit status for the result of a run.
+func exitStatus(err error) int {
+	var pe partialError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errNoNew):
+		return exitNoNew
+	case errors.As(err, &pe):
+		return exitPartial
+	default:
+		return exitFatal
+	}
+}
+
+// failure returns the error for the failed ones out of total profiles or
+// domains: fatal if all of them failed, partial otherwise.
+func failure(err error, failed, total int) error {
+	if failed < total {
+		return partialError{err}
+	}
+	return err
+}
+
+// runSummary is what happened during the run.
+type runSummary struct {
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+	// Duration is in seconds
+	Duration float64 `json:"duration"`
+	Status   int     `json:"exit_status"`
+	// Fetched is the number of webmentions received from the API
+	Fetched int `json:"fetched"`
+	// New is the number of new webmentions saved (or that would be saved
+	// on a dry run)
+	New    int      `json:"new"`
+	Files  []string `json:"files"`
+	Errors []string `json:"errors"`
+}
+
+// summary is the summary of the current run.
+var summary runSummary
+
+// wrote records the file as written.
+func (s *runSummary) wrote(fn string) {
+	for _, f := range s.Files {
+		if f == fn {
+			return
+		}
+	}
+	s.Files = append(s.Files, fn)
+}
+
+// failed records the error.
+func (s *runSummary) failed(err error) {
+	s.Errors = append(s.Errors, err.Error())
+}
+
+// save finishes the summary with the result of the run and writes it to
+// the file as JSON.
+func (s *runSummary) save(fn string, err error) error {
+	s.Duration = time.Since(s.Started).Seconds()
+	s.Status = exitStatus(err)
+	var pe partialError
+	if err != nil && !errors.Is(err, errNoNew) && !errors.As(err, &pe) {
+		s.failed(err)
+	}
+	if s.Files == nil {
+		s.Files = []string{}
+	}
+	if s.Errors == nil {
+		s.Errors = []string{}
+	}
+
+	b, jerr := json.MarshalIndent(s, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+	return safefile.Write(fn, append(b, '\n'), 0)
+}
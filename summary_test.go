@@ -0,0 +1,120 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	oops := errors.New("oops")
+	tests := map[string]struct {
+		err  error
+		want int
+	}{
+		"ok":              {nil, exitOK},
+		"fatal":           {oops, exitFatal},
+		"no new":          {errNoNew, exitNoNew},
+		"partial":         {failure(oops, 1, 2), exitPartial},
+		"all failed":      {failure(oops, 2, 2), exitFatal},
+		"wrapped partial": {fmt.Errorf("profile: %w", failure(oops, 1, 3)), exitPartial},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := exitStatus(tc.err); got != tc.want {
+				t.Fatalf("want %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunSummary(t *testing.T) {
+	page, err := ioutil.ReadFile(filepath.Join("testdata", "page.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("page") == "0" && q.Get("since_id") == "0" {
+			w.Write(page)
+			return
+		}
+		fmt.Fprint(w, `{"links":[]}`)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "webmentions.json")
+	sf := filepath.Join(dir, "summary.json")
+	args := []string{"-api", ts.URL, "-f", fn, "-summary", sf, "-nonew"}
+
+	if err := run(context.Background(), args); err != nil {
+		t.Fatal(err)
+	}
+	got := readSummary(t, sf)
+	if got.Status != exitOK || got.Fetched != 20 || got.New != 20 || !reflect.DeepEqual(got.Files, []string{fn}) {
+		t.Fatalf("unexpected summary of the first run: %+v", got)
+	}
+
+	if err := run(context.Background(), args); !errors.Is(err, errNoNew) {
+		t.Fatalf("want %v, got %v", errNoNew, err)
+	}
+	got = readSummary(t, sf)
+	if got.Status != exitNoNew || got.New != 0 || len(got.Files) != 0 || len(got.Errors) != 0 {
+		t.Fatalf("unexpected summary of the second run: %+v", got)
+	}
+}
+
+func readSummary(t *testing.T, fn string) (s runSummary) {
+	t.Helper()
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestRunSummaryFailedWrite(t *testing.T) {
+	summary = runSummary{}
+	defer func() { summary = runSummary{} }()
+
+	fn := filepath.Join(t.TempDir(), "missing", "webmentions.json")
+	mm := mustParse(t, `[{"id":1,"source":"https://src.example/"}]`)
+	for _, c := range []cfg{{filename: fn}, {filename: fn, jsonl: true}} {
+		if err := writeFile(mm, c); err == nil {
+			t.Fatal("want error writing to a missing directory")
+		}
+		if err := writeLines(mm, c, true); err == nil {
+			t.Fatal("want error appending to a missing directory")
+		}
+	}
+	if len(summary.Files) != 0 {
+		t.Fatalf("want no files written, got %v", summary.Files)
+	}
+}
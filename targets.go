@@ -0,0 +1,139 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+// targets returns the target URLs specified in the config. A target that
+// ends with "*" is a prefix.
+func targets(c cfg) (tt []string) {
+	for _, t := range strings.Split(c.target, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tt = append(tt, t)
+		}
+	}
+	return
+}
+
+// targetUrl returns the API URL to fetch all the mentions of the targets.
+func targetUrl(c cfg, tt []string) string {
+	u, _ := url.Parse(endpointUrl(c))
+	q := u.Query()
+	if len(tt) == 1 {
+		q.Set("target", tt[0])
+	} else {
+		for _, t := range tt {
+			q.Add("target[]", t)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// fetchTargets fetches all the mentions of the targets (pages or URL
+// prefixes) and adds the ones missing from the archive.
+func fetchTargets(ctx context.Context, c cfg, tt []string) error {
+	m, err := getTargets(ctx, c, tt)
+	if err != nil {
+		return err
+	}
+
+	store := newStore(c)
+	defer func() { closeStore(store) }()
+	st, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+	for _, mn := range m {
+		if !st.covers(mn, c) {
+			// saving these would make the archive look more up to
+			// date than it is, get it up to date first
+			slog.Info("some webmentions are newer than the archive, fetching new webmentions first")
+			closeStore(store)
+			if err := fetchInto(ctx, c); err != nil {
+				return err
+			}
+			store = newStore(c)
+			break
+		}
+	}
+
+	if len(m) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// the store only adds the ones missing from the archive
+	return store.Append(m)
+}
+
+// getTargets fetches all the mentions of the targets.
+func getTargets(ctx context.Context, c cfg, tt []string) ([]mention.Mention, error) {
+	var exact, prefixes []string
+	for _, t := range tt {
+		if p := strings.TrimSuffix(t, "*"); p != t {
+			prefixes = append(prefixes, p)
+		} else {
+			exact = append(exact, t)
+		}
+	}
+
+	var m []mention.Mention
+	if len(exact) > 0 {
+		mm, err := getNew(ctx, targetUrl(c, exact), nil, fetching(c))
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, mm...)
+	}
+	for _, p := range prefixes {
+		pu, err := url.Parse(p)
+		if err != nil {
+			return nil, err
+		}
+		pc := c
+		pc.domain = pu.Hostname()
+		mm, err := getNew(ctx, endpointUrl(pc), nil, fetching(c))
+		if err != nil {
+			return nil, err
+		}
+		for _, mn := range mm {
+			if strings.HasPrefix(mn.Target(), p) {
+				m = append(m, mn)
+			}
+		}
+	}
+	slog.Info("found webmentions for the targets", "count", len(m))
+	return m, nil
+}
+
+// isTarget tells whether the mention is of one of the targets.
+func isTarget(m mention.Mention, tt []string) bool {
+	for _, t := range tt {
+		if p := strings.TrimSuffix(t, "*"); p != t && strings.HasPrefix(m.Target(), p) || m.Target() == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2020 Evgeny Kuznetsov (evgeny@kuznetsov.md)
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"evgenykuznetsov.org/go/webmention.io-backup/internal/mention"
+)
+
+func TestTargetUrl(t *testing.T) {
+	tt := map[string]struct {
+		targets []string
+		want    string
+	}{
+		"single":   {[]string{"https://example.org/post/"}, "https://example.org/api?target=https%3A%2F%2Fexample.org%2Fpost%2F"},
+		"multiple": {[]string{"https://example.org/a/", "https://example.org/b/"}, "https://example.org/api?target%5B%5D=https%3A%2F%2Fexample.org%2Fa%2F&target%5B%5D=https%3A%2F%2Fexample.org%2Fb%2F"},
+	}
+
+	for name, tc := range tt {
+		t.Run(name, func(t *testing.T) {
+			got := targetUrl(cfg{api: "https://example.org/api"}, tc.targets)
+			if got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchTargets(t *testing.T) {
+	mention := func(id int, target string) string {
+		return fmt.Sprintf(`{"id":%d,"source":"https://src.example/%d","target":"%s","verified_date":"2021-06-07T22:21:1%dZ"}`, id, id, target, id%10)
+	}
+	all := map[int]string{
+		1: "https://example.org/post/",
+		2: "https://example.org/notes/1/",
+		3: "https://example.org/post/",
+		4: "https://example.org/notes/2/",
+	}
+
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("page") != "0" {
+			fmt.Fprint(w, `{"links":[]}`)
+			return
+		}
+		requests = append(requests, q.Encode())
+		since, _ := strconv.Atoi(q.Get("since_id"))
+		var page string
+		for id := since + 1; id <= len(all); id++ {
+			if target := q.Get("target"); target != "" && all[id] != target {
+				continue
+			}
+			if page != "" {
+				page += ","
+			}
+			page += mention(id, all[id])
+		}
+		fmt.Fprintf(w, `{"links":[%s]}`, page)
+	}))
+	defer ts.Close()
+
+	c := cfg{api: ts.URL, filename: filepath.Join(t.TempDir(), "wm.json")}
+	// the archive is missing mention 1, i.e. it was blocked, then approved
+	if err := writeFile(mustParse(t, `[`+mention(3, all[3])+`]`), c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fetchTargets(context.Background(), c, []string{"https://example.org/post/"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 3}; !sameIDs(t, c, want) {
+		t.Fatalf("want IDs %v", want)
+	}
+
+	// mention 4 is newer than the archive, so the new ones are fetched first
+	if err := fetchTargets(context.Background(), c, []string{"https://example.org/notes/*"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4}; !sameIDs(t, c, want) {
+		t.Fatalf("want IDs %v", want)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("want 3 requests, got %d: %v", len(requests), requests)
+	}
+}
+
+func mustParse(t *testing.T, s string) []mention.Mention {
+	t.Helper()
+	mm, err := parsePage([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mm
+}
+
+func sameIDs(t *testing.T, c cfg, want []int) bool {
+	t.Helper()
+	mm, err := readFile(c.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, m := range mm {
+		got = append(got, m.ID())
+	}
+	sort.Ints(got)
+	t.Logf("got IDs %v", got)
+	return fmt.Sprint(got) == fmt.Sprint(want)
+}